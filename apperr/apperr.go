@@ -0,0 +1,78 @@
+// Package apperr classifies the failures of the tool, so the command line
+// can map them to exit codes and library users can tell them apart.
+package apperr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kind is the class of a failure.
+type Kind int
+
+const (
+	Unknown     Kind = iota
+	Connection       // the database cannot be reached or dropped the connection
+	Query            // a statement failed or timed out
+	DataQuality      // rows or files hold values that cannot be used
+	Config           // flags, options or paths given by the user are invalid
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Connection:
+		return "connection"
+	case Query:
+		return "query"
+	case DataQuality:
+		return "data quality"
+	case Config:
+		return "config"
+	}
+	return "unknown"
+}
+
+// Error is a failure of one Kind. Op says what was being done.
+type Error struct {
+	Kind Kind
+	Op   string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Op == "" {
+		return e.Err.Error()
+	}
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap adds op to err as a failure of kind. An err that already has a Kind
+// keeps it. Wrap returns nil when err is nil.
+func Wrap(kind Kind, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var known *Error
+	if errors.As(err, &known) {
+		kind = known.Kind
+	}
+	return &Error{Kind: kind, Op: op, Err: err}
+}
+
+// Errorf is a new failure of kind, formatted like fmt.Errorf.
+func Errorf(kind Kind, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// KindOf is the Kind of the first Error in the chain of err, Unknown if none.
+func KindOf(err error) Kind {
+	var known *Error
+	if errors.As(err, &known) {
+		return known.Kind
+	}
+	return Unknown
+}
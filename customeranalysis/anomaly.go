@@ -0,0 +1,202 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AnomalyConfig sets when a purchase event is flagged for review.
+type AnomalyConfig struct {
+	// Threshold is the robust z-score, 0.6745 (x - median) / MAD, above
+	// which an event is unusual for its customer or its content.
+	Threshold float64
+	MinEvents int // events needed to build a baseline
+	// BurstEvents purchases of a customer within BurstWindow are a burst.
+	BurstWindow time.Duration
+	BurstEvents int
+	// Exclude leaves the flagged events out of every other result.
+	Exclude bool
+}
+
+// AnomalousEvent is a purchase flagged for review.
+type AnomalousEvent struct {
+	CustomerEvent
+	Value   Money   // price x quantity
+	Score   float64 // highest robust z-score, 0 for a burst only
+	Reasons []string
+}
+
+// robustScorer computes robust z-scores against the median and MAD of a
+// baseline.
+type robustScorer struct {
+	median, mad float64
+}
+
+func newRobustScorer(values []float64) (robustScorer, bool) {
+	med := median(values)
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - med)
+	}
+	mad := median(deviations)
+	if mad == 0 {
+		// more than half the values are equal: fall back on the mean
+		// absolute deviation, z = (x - median) / (1.2533 * meanAD)
+		var sum float64
+		for _, d := range deviations {
+			sum += d
+		}
+		mad = 0.6745 * 1.2533 * sum / float64(len(values))
+	}
+	return robustScorer{median: med, mad: mad}, mad > 0
+}
+
+func (s robustScorer) score(v float64) float64 {
+	return 0.6745 * (v - s.median) / s.mad
+}
+
+// detectAnomalies flags the purchases far above the usual value of their
+// customer, far above the usual quantity of their content, or part of a
+// burst of purchases. Only high values are flagged: a small purchase does
+// not distort the ranking.
+func detectAnomalies(events []CustomerEvent, contentPrices map[int]Money, cfg AnomalyConfig) []AnomalousEvent {
+	flagged := make(map[int]*AnomalousEvent)
+	flag := func(e CustomerEvent, score float64, reason string) {
+		a, ok := flagged[e.EventDataID]
+		if !ok {
+			a = &AnomalousEvent{CustomerEvent: e, Value: contentPrices[e.ContentID].Mul(e.Quantity)}
+			flagged[e.EventDataID] = a
+		}
+		a.Score = math.Max(a.Score, score)
+		a.Reasons = append(a.Reasons, reason)
+	}
+
+	byCustomer := make(map[int][]CustomerEvent)
+	byContent := make(map[int][]CustomerEvent)
+	pricedEvents(events, contentPrices, func(e CustomerEvent, _ Money) {
+		byCustomer[e.CustomerID] = append(byCustomer[e.CustomerID], e)
+		byContent[e.ContentID] = append(byContent[e.ContentID], e)
+	})
+
+	// value against the customer's own purchases
+	for _, customerEvents := range byCustomer {
+		if len(customerEvents) < cfg.MinEvents {
+			continue
+		}
+		values := make([]float64, len(customerEvents))
+		for i, e := range customerEvents {
+			values[i] = contentPrices[e.ContentID].Mul(e.Quantity).Float64()
+		}
+		scorer, ok := newRobustScorer(values)
+		if !ok {
+			continue
+		}
+		for i, e := range customerEvents {
+			if z := scorer.score(values[i]); z > cfg.Threshold {
+				flag(e, z, fmt.Sprintf("value %.2f, customer median %.2f (z %.1f)", values[i], scorer.median, z))
+			}
+		}
+	}
+
+	// quantity against every purchase of the content
+	for _, contentEvents := range byContent {
+		if len(contentEvents) < cfg.MinEvents {
+			continue
+		}
+		quantities := make([]float64, len(contentEvents))
+		for i, e := range contentEvents {
+			quantities[i] = float64(e.Quantity)
+		}
+		scorer, ok := newRobustScorer(quantities)
+		if !ok {
+			continue
+		}
+		for i, e := range contentEvents {
+			if z := scorer.score(quantities[i]); z > cfg.Threshold {
+				flag(e, z, fmt.Sprintf("quantity %d, content median %.0f (z %.1f)", e.Quantity, scorer.median, z))
+			}
+		}
+	}
+
+	// bursts: every event of a window holding BurstEvents purchases or more
+	if cfg.BurstEvents > 0 {
+		for _, customerEvents := range byCustomer {
+			sorted := append([]CustomerEvent(nil), customerEvents...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i].EventDate.Before(sorted[j].EventDate) })
+			inBurst := make([]bool, len(sorted))
+			start := 0
+			for end := range sorted {
+				for sorted[end].EventDate.Sub(sorted[start].EventDate) > cfg.BurstWindow {
+					start++
+				}
+				if end-start+1 >= cfg.BurstEvents {
+					for i := start; i <= end; i++ {
+						inBurst[i] = true
+					}
+				}
+			}
+			for i, e := range sorted {
+				if inBurst[i] {
+					flag(e, 0, fmt.Sprintf("burst of %d+ purchases within %s", cfg.BurstEvents, cfg.BurstWindow))
+				}
+			}
+		}
+	}
+
+	anomalies := make([]AnomalousEvent, 0, len(flagged))
+	for _, a := range flagged {
+		anomalies = append(anomalies, *a)
+	}
+	sort.Slice(anomalies, func(i, j int) bool {
+		if anomalies[i].Value != anomalies[j].Value {
+			return anomalies[i].Value > anomalies[j].Value
+		}
+		return anomalies[i].EventDataID < anomalies[j].EventDataID
+	})
+	return anomalies
+}
+
+// withoutAnomalies drops the flagged events from data and ranks the
+// customers again on what is left.
+func withoutAnomalies(data SalesData, anomalies []AnomalousEvent) SalesData {
+	flagged := make(map[int]bool, len(anomalies))
+	for _, a := range anomalies {
+		flagged[a.EventDataID] = true
+	}
+	kept := make([]CustomerEvent, 0, len(data.Events))
+	for _, e := range data.Events {
+		if !flagged[e.EventDataID] {
+			kept = append(kept, e)
+		}
+	}
+	data.Events = kept
+	data.Customers = MakeCustomerSales(kept, data.CustomerData, data.ContentPrices)
+	sortCustomers(data.Customers)
+	return data
+}
+
+// insertAnomalies replaces the content of the AnomalyReview table.
+func insertAnomalies(ctx context.Context, db *sql.DB, anomalies []AnomalousEvent, excluded bool) error {
+	rows := make([][]interface{}, len(anomalies))
+	for i, a := range anomalies {
+		rows[i] = []interface{}{a.EventDataID, a.CustomerID, a.ContentID, a.EventDate, a.Quantity, a.Value, a.Score, strings.Join(a.Reasons, "; "), excluded}
+	}
+	return replaceTable(ctx, db, `
+	CREATE TABLE IF NOT EXISTS AnomalyReview (
+		EventDataID INT PRIMARY KEY,
+		CustomerID INT,
+		ContentID INT,
+		EventDate DATETIME,
+		Quantity INT,
+		Value DECIMAL(18,4),
+		Score DOUBLE,
+		Reasons VARCHAR(512),
+		ExcludedFromRanking BOOLEAN
+	);`, "AnomalyReview",
+		[]string{"EventDataID", "CustomerID", "ContentID", "EventDate", "Quantity", "Value", "Score", "Reasons", "ExcludedFromRanking"}, rows)
+}
@@ -0,0 +1,97 @@
+package customeranalysis
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRobustScorer(t *testing.T) {
+	tests := []struct {
+		values []float64
+		x      float64
+		want   float64 // score of x
+		ok     bool
+	}{
+		// median 3, deviations 2 1 0 1 97, MAD 1
+		{[]float64{1, 2, 3, 4, 100}, 100, 0.6745 * 97, true},
+		{[]float64{1, 2, 3, 4, 100}, 3, 0, true},
+		// MAD 0: the mean absolute deviation 20/5 = 4 replaces it
+		{[]float64{5, 5, 5, 5, 25}, 25, 20 / (1.2533 * 4), true},
+		{[]float64{5, 5, 5}, 5, 0, false},
+	}
+	for _, tt := range tests {
+		scorer, ok := newRobustScorer(tt.values)
+		if ok != tt.ok {
+			t.Errorf("newRobustScorer(%v) ok = %v, want %v", tt.values, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if got := scorer.score(tt.x); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("score of %v against %v = %v, want %v", tt.x, tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	day := func(d int, minutes int) time.Time {
+		return time.Date(2023, 5, d, 12, 0, 0, 0, time.UTC).Add(time.Duration(minutes) * time.Minute)
+	}
+	prices := map[int]Money{1: 100000, 2: 10000}
+	events := []CustomerEvent{
+		// customer 1 buys 1 of content 1 four times, then 10
+		{EventDataID: 1, CustomerID: 1, ContentID: 1, Quantity: 1, EventDate: day(1, 0)},
+		{EventDataID: 2, CustomerID: 1, ContentID: 1, Quantity: 1, EventDate: day(2, 0)},
+		{EventDataID: 3, CustomerID: 1, ContentID: 1, Quantity: 1, EventDate: day(3, 0)},
+		{EventDataID: 4, CustomerID: 1, ContentID: 1, Quantity: 1, EventDate: day(4, 0)},
+		{EventDataID: 5, CustomerID: 1, ContentID: 1, Quantity: 10, EventDate: day(5, 0)},
+		// customer 2 buys three times within the hour, then once more
+		{EventDataID: 6, CustomerID: 2, ContentID: 2, Quantity: 1, EventDate: day(10, 0)},
+		{EventDataID: 7, CustomerID: 2, ContentID: 2, Quantity: 1, EventDate: day(10, 20)},
+		{EventDataID: 8, CustomerID: 2, ContentID: 2, Quantity: 1, EventDate: day(10, 60)},
+		{EventDataID: 9, CustomerID: 2, ContentID: 2, Quantity: 1, EventDate: day(12, 0)},
+		// no price, never a baseline nor flagged
+		{EventDataID: 10, CustomerID: 1, ContentID: 9, Quantity: 1000, EventDate: day(6, 0)},
+	}
+	cfg := AnomalyConfig{Threshold: 3.5, MinEvents: 5, BurstWindow: time.Hour, BurstEvents: 3}
+	got := detectAnomalies(events, prices, cfg)
+
+	// values 10 10 10 10 100 and quantities 1 1 1 1 10 have a MAD of 0: the
+	// mean absolute deviations, 18 and 1.8, give both a z of 90 / 22.56
+	burst := "burst of 3+ purchases within 1h0m0s"
+	want := []AnomalousEvent{
+		{CustomerEvent: events[4], Value: 1000000, Score: 90 / (1.2533 * 18), Reasons: []string{
+			"value 100.00, customer median 10.00 (z 4.0)",
+			"quantity 10, content median 1 (z 4.0)",
+		}},
+		{CustomerEvent: events[5], Value: 10000, Reasons: []string{burst}},
+		{CustomerEvent: events[6], Value: 10000, Reasons: []string{burst}},
+		{CustomerEvent: events[7], Value: 10000, Reasons: []string{burst}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("detectAnomalies = %+v, want %+v", got, want)
+	}
+	for i, a := range got {
+		w := want[i]
+		if math.Abs(a.Score-w.Score) > 1e-9 {
+			t.Errorf("anomaly %d score = %v, want %v", a.EventDataID, a.Score, w.Score)
+		}
+		a.Score = w.Score
+		if !reflect.DeepEqual(a, w) {
+			t.Errorf("anomaly %d = %+v, want %+v", i, a, w)
+		}
+	}
+
+	data := SalesData{Events: events, CustomerData: map[int]string{1: "one", 2: "two"}, ContentPrices: prices}
+	data = withoutAnomalies(data, got)
+	if len(data.Events) != 6 {
+		t.Errorf("kept %d events, want 6", len(data.Events))
+	}
+	wantCustomers := []Customer{{CustomerID: 1, Information: "one", TotalSales: 400000}, {CustomerID: 2, Information: "two", TotalSales: 10000}}
+	if !reflect.DeepEqual(data.Customers, wantCustomers) {
+		t.Errorf("customers without the anomalies = %+v, want %+v", data.Customers, wantCustomers)
+	}
+}
@@ -0,0 +1,125 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+)
+
+// BasketConfig sets the thresholds of the co-purchase rules. A basket is
+// every content a customer bought since PurchasesSince.
+type BasketConfig struct {
+	MinSupport    float64 // share of the baskets holding both contents
+	MinConfidence float64
+	TopRules      int // rules kept, best lift first (0 keeps them all)
+}
+
+// AssociationRule reads "customers who bought Antecedent also bought
+// Consequent".
+type AssociationRule struct {
+	Antecedent int // ContentID
+	Consequent int
+	Baskets    int // baskets holding both
+	Support    float64
+	Confidence float64 // Support / support of Antecedent
+	Lift       float64 // Confidence / support of Consequent
+}
+
+// computeBasketRules counts the content pairs bought by the same customer,
+// Apriori style: only contents frequent enough on their own can make a
+// frequent pair.
+func computeBasketRules(events []CustomerEvent, cfg BasketConfig) []AssociationRule {
+	baskets := make(map[int]map[int]bool)
+	for _, e := range events {
+		if baskets[e.CustomerID] == nil {
+			baskets[e.CustomerID] = make(map[int]bool)
+		}
+		baskets[e.CustomerID][e.ContentID] = true
+	}
+	n := float64(len(baskets))
+	if n == 0 {
+		return nil
+	}
+
+	itemCounts := make(map[int]int)
+	for _, basket := range baskets {
+		for contentID := range basket {
+			itemCounts[contentID]++
+		}
+	}
+
+	type pair struct{ a, b int } // a < b
+	pairCounts := make(map[pair]int)
+	for _, basket := range baskets {
+		var frequent []int
+		for contentID := range basket {
+			if float64(itemCounts[contentID])/n >= cfg.MinSupport {
+				frequent = append(frequent, contentID)
+			}
+		}
+		sort.Ints(frequent)
+		for i, a := range frequent {
+			for _, b := range frequent[i+1:] {
+				pairCounts[pair{a, b}]++
+			}
+		}
+	}
+
+	var rules []AssociationRule
+	for p, count := range pairCounts {
+		support := float64(count) / n
+		if support < cfg.MinSupport {
+			continue
+		}
+		for _, r := range [][2]int{{p.a, p.b}, {p.b, p.a}} {
+			rule := AssociationRule{
+				Antecedent: r[0],
+				Consequent: r[1],
+				Baskets:    count,
+				Support:    support,
+				Confidence: float64(count) / float64(itemCounts[r[0]]),
+			}
+			rule.Lift = rule.Confidence / (float64(itemCounts[r[1]]) / n)
+			if rule.Confidence >= cfg.MinConfidence {
+				rules = append(rules, rule)
+			}
+		}
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		if a.Lift != b.Lift {
+			return a.Lift > b.Lift
+		}
+		if a.Confidence != b.Confidence {
+			return a.Confidence > b.Confidence
+		}
+		if a.Antecedent != b.Antecedent {
+			return a.Antecedent < b.Antecedent
+		}
+		return a.Consequent < b.Consequent
+	})
+	if cfg.TopRules > 0 && len(rules) > cfg.TopRules {
+		rules = rules[:cfg.TopRules]
+	}
+	return rules
+}
+
+// insertBasketRules replaces the content of the AssociationRules table.
+func insertBasketRules(ctx context.Context, db *sql.DB, rules []AssociationRule) error {
+	rows := make([][]interface{}, len(rules))
+	for i, r := range rules {
+		rows[i] = []interface{}{r.Antecedent, r.Consequent, r.Baskets, r.Support, r.Confidence, r.Lift}
+	}
+	return replaceTable(ctx, db, `
+	CREATE TABLE IF NOT EXISTS AssociationRules (
+		ID INT AUTO_INCREMENT PRIMARY KEY,
+		AntecedentContentID INT,
+		ConsequentContentID INT,
+		Baskets INT,
+		Support DOUBLE,
+		Confidence DOUBLE,
+		Lift DOUBLE
+	);`, "AssociationRules",
+		[]string{"AntecedentContentID", "ConsequentContentID", "Baskets", "Support", "Confidence", "Lift"}, rows)
+}
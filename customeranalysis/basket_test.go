@@ -0,0 +1,76 @@
+package customeranalysis
+
+import (
+	"math"
+	"testing"
+)
+
+func TestComputeBasketRules(t *testing.T) {
+	baskets := map[int][]int{
+		1: {1, 2, 3},
+		2: {1, 2},
+		3: {1, 2},
+		4: {1, 3},
+		5: {4, 4}, // bought twice, one basket
+		6: {2},
+	}
+	var events []CustomerEvent
+	for customerID, contents := range baskets {
+		for _, contentID := range contents {
+			events = append(events, CustomerEvent{CustomerID: customerID, ContentID: contentID, Quantity: 1})
+		}
+	}
+
+	// 6 baskets: content 1 in 4, 2 in 4, 3 in 2, 4 in 1; {1, 2} in 3,
+	// {1, 3} in 2, {2, 3} in 1
+	tests := []struct {
+		name string
+		cfg  BasketConfig
+		want []AssociationRule
+	}{
+		{
+			// {2, 3} has a support of 1/6, 1 -> 3 a confidence of 2/4
+			name: "support 0.3, confidence 0.6",
+			cfg:  BasketConfig{MinSupport: 0.3, MinConfidence: 0.6},
+			want: []AssociationRule{
+				{Antecedent: 3, Consequent: 1, Baskets: 2, Support: 2.0 / 6, Confidence: 1, Lift: 1 / (4.0 / 6)},
+				{Antecedent: 1, Consequent: 2, Baskets: 3, Support: 0.5, Confidence: 0.75, Lift: 0.75 / (4.0 / 6)},
+				{Antecedent: 2, Consequent: 1, Baskets: 3, Support: 0.5, Confidence: 0.75, Lift: 0.75 / (4.0 / 6)},
+			},
+		},
+		{
+			name: "best rule only",
+			cfg:  BasketConfig{MinSupport: 0.3, MinConfidence: 0.6, TopRules: 1},
+			want: []AssociationRule{
+				{Antecedent: 3, Consequent: 1, Baskets: 2, Support: 2.0 / 6, Confidence: 1, Lift: 1 / (4.0 / 6)},
+			},
+		},
+		{
+			// content 3 is not frequent on its own, so no pair has it
+			name: "support 0.5",
+			cfg:  BasketConfig{MinSupport: 0.5},
+			want: []AssociationRule{
+				{Antecedent: 1, Consequent: 2, Baskets: 3, Support: 0.5, Confidence: 0.75, Lift: 0.75 / (4.0 / 6)},
+				{Antecedent: 2, Consequent: 1, Baskets: 3, Support: 0.5, Confidence: 0.75, Lift: 0.75 / (4.0 / 6)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := computeBasketRules(events, tt.cfg)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d rules %+v, want %+v", tt.name, len(got), got, tt.want)
+			continue
+		}
+		for i, r := range got {
+			w := tt.want[i]
+			if r.Antecedent != w.Antecedent || r.Consequent != w.Consequent || r.Baskets != w.Baskets ||
+				math.Abs(r.Support-w.Support) > 1e-12 || math.Abs(r.Confidence-w.Confidence) > 1e-12 || math.Abs(r.Lift-w.Lift) > 1e-12 {
+				t.Errorf("%s: rule %d = %+v, want %+v", tt.name, i, r, w)
+			}
+		}
+	}
+
+	if rules := computeBasketRules(nil, BasketConfig{}); rules != nil {
+		t.Errorf("rules without purchases = %+v, want none", rules)
+	}
+}
@@ -0,0 +1,239 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"TEST2024/database"
+)
+
+// ChurnConfig sets when a customer is flagged as at risk.
+type ChurnConfig struct {
+	// RecentDays is the window, ending at the latest purchase in the data,
+	// compared with the purchase rate of the customer before it.
+	RecentDays int
+	// DropRatio flags a customer buying less than this share of the
+	// purchases expected from their own history.
+	DropRatio    float64
+	MinPurchases int // purchases needed before the window to have a history
+	// TopDays flags a customer who was in the daily top tables this many
+	// consecutive days and is not in the current top anymore.
+	TopDays int
+}
+
+// TopSnapshot is the content of one daily test_2024_YYYYMMDD table.
+type TopSnapshot struct {
+	Date      time.Time
+	Customers map[int]bool
+}
+
+// ChurnRisk is a flagged customer, with every reason found.
+type ChurnRisk struct {
+	Rank              int
+	CustomerID        int
+	Information       string
+	TotalSales        Money
+	Reasons           []string
+	RecentPurchases   int
+	ExpectedPurchases float64 // in the window, at the historical rate
+	TopStreak         int     // consecutive days in the top before leaving it
+}
+
+// FetchTopHistory reads the daily top customers tables written before today,
+// oldest first. Today's table is left out: the current run rewrites it.
+func FetchTopHistory(ctx context.Context, db *sql.DB) ([]TopSnapshot, error) {
+	queryCtx, cancel := database.WithQueryTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(queryCtx, `SHOW TABLES LIKE 'test\_2024\_%'`)
+	if err != nil {
+		return nil, database.Classify("listing the top customers tables", err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, database.Classify("listing the top customers tables", err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, database.Classify("listing the top customers tables", err)
+	}
+	rows.Close()
+	sort.Strings(names)
+
+	today := time.Now().Format("20060102")
+	var history []TopSnapshot
+	for _, name := range names {
+		day := strings.TrimPrefix(name, "test_2024_")
+		date, err := time.Parse("20060102", day)
+		if err != nil || day >= today {
+			continue
+		}
+		snapshot := TopSnapshot{Date: date, Customers: make(map[int]bool)}
+		if err := readTopSnapshot(ctx, db, name, snapshot.Customers); err != nil {
+			return nil, err
+		}
+		history = append(history, snapshot)
+	}
+	return history, nil
+}
+
+func readTopSnapshot(ctx context.Context, db *sql.DB, table string, customers map[int]bool) error {
+	ctx, cancel := database.WithQueryTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SELECT CustomerID FROM "+table)
+	if err != nil {
+		return database.Classify("reading "+table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var customerID int
+		if err := rows.Scan(&customerID); err != nil {
+			return database.Classify("reading "+table, err)
+		}
+		customers[customerID] = true
+	}
+	return database.Classify("reading "+table, rows.Err())
+}
+
+// computeChurn flags the customers, the most flags first, then the biggest
+// TotalSales.
+func computeChurn(events []CustomerEvent, customers, top []Customer, history []TopSnapshot, cfg ChurnConfig) []ChurnRisk {
+	byCustomer := make(map[int]*ChurnRisk)
+	flag := func(c Customer, reason string) *ChurnRisk {
+		r, ok := byCustomer[c.CustomerID]
+		if !ok {
+			r = &ChurnRisk{CustomerID: c.CustomerID, Information: c.Information, TotalSales: c.TotalSales}
+			byCustomer[c.CustomerID] = r
+		}
+		r.Reasons = append(r.Reasons, reason)
+		return r
+	}
+	info := make(map[int]Customer, len(customers))
+	for _, c := range customers {
+		info[c.CustomerID] = c
+	}
+
+	// purchase rate drop
+	var latest time.Time
+	first := make(map[int]time.Time)
+	for _, e := range events {
+		if e.EventDate.After(latest) {
+			latest = e.EventDate
+		}
+		if f, ok := first[e.CustomerID]; !ok || e.EventDate.Before(f) {
+			first[e.CustomerID] = e.EventDate
+		}
+	}
+	windowStart := latest.AddDate(0, 0, -cfg.RecentDays)
+	before := make(map[int]int)
+	recent := make(map[int]int)
+	for _, e := range events {
+		if e.EventDate.After(windowStart) {
+			recent[e.CustomerID]++
+		} else {
+			before[e.CustomerID]++
+		}
+	}
+	ids := make([]int, 0, len(before))
+	for customerID := range before {
+		ids = append(ids, customerID)
+	}
+	sort.Ints(ids)
+	for _, customerID := range ids {
+		n := before[customerID]
+		days := windowStart.Sub(first[customerID]).Hours() / 24
+		if n < cfg.MinPurchases || days < 1 {
+			continue
+		}
+		expected := float64(n) / days * float64(cfg.RecentDays)
+		if float64(recent[customerID]) < cfg.DropRatio*expected {
+			r := flag(info[customerID], fmt.Sprintf("%d purchases in the last %d days, %.1f expected from history",
+				recent[customerID], cfg.RecentDays, expected))
+			r.RecentPurchases = recent[customerID]
+			r.ExpectedPurchases = expected
+		}
+	}
+
+	// left the top set after a streak in it
+	if len(history) > 0 {
+		current := make(map[int]bool, len(top))
+		for _, c := range top {
+			current[c.CustomerID] = true
+		}
+		last := history[len(history)-1]
+		ids = ids[:0]
+		for customerID := range last.Customers {
+			ids = append(ids, customerID)
+		}
+		sort.Ints(ids)
+		for _, customerID := range ids {
+			if current[customerID] {
+				continue
+			}
+			streak := 0
+			for i := len(history) - 1; i >= 0 && history[i].Customers[customerID]; i-- {
+				streak++
+				if i > 0 && history[i].Date.Sub(history[i-1].Date) > 24*time.Hour {
+					break // a day without a table ends the streak
+				}
+			}
+			if streak < cfg.TopDays {
+				continue
+			}
+			c, ok := info[customerID]
+			if !ok {
+				c = Customer{CustomerID: customerID}
+			}
+			r := flag(c, fmt.Sprintf("left the top customers after %d consecutive days (last on %s)",
+				streak, last.Date.Format("2006-01-02")))
+			r.TopStreak = streak
+		}
+	}
+
+	risks := make([]ChurnRisk, 0, len(byCustomer))
+	for _, r := range byCustomer {
+		risks = append(risks, *r)
+	}
+	sort.Slice(risks, func(i, j int) bool {
+		a, b := risks[i], risks[j]
+		if len(a.Reasons) != len(b.Reasons) {
+			return len(a.Reasons) > len(b.Reasons)
+		}
+		if a.TotalSales != b.TotalSales {
+			return a.TotalSales > b.TotalSales
+		}
+		return a.CustomerID < b.CustomerID
+	})
+	for i := range risks {
+		risks[i].Rank = i + 1
+	}
+	return risks
+}
+
+// insertChurn replaces the content of the ChurnRisk table.
+func insertChurn(ctx context.Context, db *sql.DB, risks []ChurnRisk) error {
+	rows := make([][]interface{}, len(risks))
+	for i, r := range risks {
+		rows[i] = []interface{}{r.Rank, r.CustomerID, r.Information, r.TotalSales, strings.Join(r.Reasons, "; "), r.RecentPurchases, r.ExpectedPurchases, r.TopStreak}
+	}
+	return replaceTable(ctx, db, `
+	CREATE TABLE IF NOT EXISTS ChurnRisk (
+		RiskRank INT PRIMARY KEY,
+		CustomerID INT,
+		INFO CHAR(255),
+		TotalSales DECIMAL(18,4),
+		Reasons VARCHAR(512),
+		RecentPurchases INT,
+		ExpectedPurchases DOUBLE,
+		TopStreak INT
+	);`, "ChurnRisk",
+		[]string{"RiskRank", "CustomerID", "INFO", "TotalSales", "Reasons", "RecentPurchases", "ExpectedPurchases", "TopStreak"}, rows)
+}
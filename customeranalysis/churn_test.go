@@ -0,0 +1,72 @@
+package customeranalysis
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestComputeChurn(t *testing.T) {
+	date := func(month time.Month, d, hour int) time.Time {
+		return time.Date(2023, month, d, hour, 0, 0, 0, time.UTC)
+	}
+	var events []CustomerEvent
+	buy := func(customerID int, dates ...time.Time) {
+		for _, d := range dates {
+			events = append(events, CustomerEvent{CustomerID: customerID, ContentID: 1, Quantity: 1, EventDate: d})
+		}
+	}
+	history := []time.Time{date(time.March, 11, 0), date(time.March, 15, 0), date(time.March, 20, 0), date(time.March, 25, 0)}
+	// the latest purchase is on April 10, so the 10 day window starts on
+	// March 31: 4 purchases in the 20 days before it make 2 expected
+	buy(1, history...)
+	buy(2, history...)
+	buy(3, history[0], history[2]) // too few purchases to have a history
+	buy(4, history...)
+	buy(4, date(time.April, 1, 0), date(time.April, 5, 0), date(time.April, 10, 0))
+	buy(5, date(time.March, 30, 12), date(time.March, 30, 12), date(time.March, 30, 12)) // history shorter than a day
+
+	customers := []Customer{
+		{CustomerID: 1, Information: "one", TotalSales: 500000},
+		{CustomerID: 2, Information: "two", TotalSales: 300000},
+		{CustomerID: 3, Information: "three", TotalSales: 200000},
+		{CustomerID: 4, Information: "four", TotalSales: 700000},
+		{CustomerID: 5, Information: "five", TotalSales: 100000},
+	}
+	snapshot := func(d int, customerIDs ...int) TopSnapshot {
+		s := TopSnapshot{Date: date(time.April, d, 0), Customers: make(map[int]bool)}
+		for _, id := range customerIDs {
+			s.Customers[id] = true
+		}
+		return s
+	}
+	// the day without a table between April 2 and 6 ends the streaks; 6 is
+	// not in the Customer table, 7 is still in the top, 8 and 9 were not
+	// in it long enough
+	tops := []TopSnapshot{
+		snapshot(2, 1, 9),
+		snapshot(6, 1, 6),
+		snapshot(7, 1, 6, 7),
+		snapshot(8, 1, 6, 7, 9),
+		snapshot(9, 1, 6, 7, 8, 9),
+	}
+	top := []Customer{{CustomerID: 7}}
+
+	cfg := ChurnConfig{RecentDays: 10, DropRatio: 0.5, MinPurchases: 3, TopDays: 3}
+	got := computeChurn(events, customers, top, tops, cfg)
+	left := "left the top customers after 4 consecutive days (last on 2023-04-09)"
+	dropped := "0 purchases in the last 10 days, 2.0 expected from history"
+	want := []ChurnRisk{
+		{Rank: 1, CustomerID: 1, Information: "one", TotalSales: 500000, Reasons: []string{dropped, left}, ExpectedPurchases: 2, TopStreak: 4},
+		{Rank: 2, CustomerID: 2, Information: "two", TotalSales: 300000, Reasons: []string{dropped}, ExpectedPurchases: 2},
+		{Rank: 3, CustomerID: 6, Reasons: []string{left}, TopStreak: 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("computeChurn =\n%+v\nwant\n%+v", got, want)
+	}
+
+	cfg.TopDays = 5
+	if got := computeChurn(events, customers, top, tops, cfg); len(got) != 2 {
+		t.Errorf("with 5 days in the top needed: %+v, want the 2 purchase drops only", got)
+	}
+}
@@ -0,0 +1,382 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"time"
+)
+
+// CLVModel chooses how the customer lifetime value is predicted.
+type CLVModel string
+
+const (
+	// CLVProbabilistic fits BG/NBD for the number of purchases and
+	// Gamma-Gamma for their value. It falls back to CLVHeuristic when the
+	// data cannot support the fit (too few repeat buyers, no convergence).
+	CLVProbabilistic CLVModel = "bgnbd"
+	// CLVHeuristic extrapolates each customer's observed purchase rate and
+	// average purchase value, damped by Retention.
+	CLVHeuristic CLVModel = "heuristic"
+)
+
+// CLVConfig configures the CLV module.
+type CLVConfig struct {
+	Model       CLVModel
+	HorizonDays float64 // prediction horizon, 365 for a 12-month value
+	// Retention is the share of the observed purchase rate the heuristic
+	// expects to keep over the horizon.
+	Retention float64
+}
+
+// CustomerCLV is the predicted value of a customer over the horizon.
+type CustomerCLV struct {
+	CustomerID         int
+	TotalSales         Money
+	Purchases          int // days with at least one purchase
+	PredictedPurchases float64
+	PredictedAvgValue  Money
+	PredictedValue     Money
+	Model              CLVModel
+}
+
+// clvPrediction is what a model predicts for one customer, before rounding.
+type clvPrediction struct {
+	purchases float64
+	avgValue  float64
+	model     CLVModel
+}
+
+// purchaseHistory is the summary the models work on. A transaction is a day
+// with purchases; times are in weeks.
+type purchaseHistory struct {
+	customerID int
+	total      Money
+	x          float64 // repeat transactions
+	tx         float64 // age of the customer at the last transaction
+	T          float64 // age of the customer at the end of the observation
+	avgValue   float64 // average value of a transaction
+}
+
+const week = 7 * 24 * time.Hour
+
+func purchaseHistories(events []CustomerEvent, contentPrices map[int]Money) []purchaseHistory {
+	type day struct {
+		customerID int
+		date       string
+	}
+	dayValues := make(map[day]Money)
+	first := make(map[int]time.Time)
+	last := make(map[int]time.Time)
+	var end time.Time
+	pricedEvents(events, contentPrices, func(e CustomerEvent, value Money) {
+		dayValues[day{e.CustomerID, e.EventDate.Format("2006-01-02")}] += value
+		if f, ok := first[e.CustomerID]; !ok || e.EventDate.Before(f) {
+			first[e.CustomerID] = e.EventDate
+		}
+		if e.EventDate.After(last[e.CustomerID]) {
+			last[e.CustomerID] = e.EventDate
+		}
+		if e.EventDate.After(end) {
+			end = e.EventDate
+		}
+	})
+
+	byCustomer := make(map[int]*purchaseHistory)
+	for d, value := range dayValues {
+		h, ok := byCustomer[d.customerID]
+		if !ok {
+			h = &purchaseHistory{
+				customerID: d.customerID,
+				x:          -1,
+				tx:         float64(last[d.customerID].Sub(first[d.customerID])) / float64(week),
+				T:          float64(end.Sub(first[d.customerID])) / float64(week),
+			}
+			byCustomer[d.customerID] = h
+		}
+		h.x++
+		h.total += value
+	}
+
+	histories := make([]purchaseHistory, 0, len(byCustomer))
+	for _, h := range byCustomer {
+		h.avgValue = h.total.Float64() / (h.x + 1)
+		histories = append(histories, *h)
+	}
+	sort.Slice(histories, func(i, j int) bool { return histories[i].customerID < histories[j].customerID })
+	return histories
+}
+
+// computeCLV predicts the value of every customer over cfg.HorizonDays.
+func computeCLV(events []CustomerEvent, contentPrices map[int]Money, cfg CLVConfig) []CustomerCLV {
+	histories := purchaseHistories(events, contentPrices)
+	horizon := cfg.HorizonDays / 7
+
+	heuristic := heuristicCLV(cfg.Retention, horizon)
+	predict := heuristic
+	if cfg.Model == CLVProbabilistic {
+		p, err := probabilisticCLV(histories, horizon)
+		if err != nil {
+			slog.Warn("CLV falls back to the heuristic for every customer", "reason", err)
+		} else {
+			predict = p
+		}
+	}
+
+	clv := make([]CustomerCLV, 0, len(histories))
+	for _, h := range histories {
+		p := predict(h)
+		if anyInvalid(p.purchases, p.avgValue) || p.purchases < 0 {
+			slog.Warn("CLV falls back to the heuristic", "customer", h.customerID,
+				"purchases", p.purchases, "avg_value", p.avgValue)
+			p = heuristic(h)
+		}
+		clv = append(clv, CustomerCLV{
+			CustomerID:         h.customerID,
+			TotalSales:         h.total,
+			Purchases:          int(h.x + 1),
+			PredictedPurchases: p.purchases,
+			PredictedAvgValue:  MoneyFromFloat(p.avgValue),
+			PredictedValue:     MoneyFromFloat(p.purchases * p.avgValue),
+			Model:              p.model,
+		})
+	}
+	return clv
+}
+
+// heuristicCLV: purchases per week since the first one (at least 4 weeks of
+// history, so a single recent purchase is not read as a weekly habit).
+func heuristicCLV(retention, horizon float64) func(purchaseHistory) clvPrediction {
+	return func(h purchaseHistory) clvPrediction {
+		rate := (h.x + 1) / math.Max(h.T, 4)
+		return clvPrediction{
+			purchases: rate * horizon * retention,
+			avgValue:  h.avgValue,
+			model:     CLVHeuristic,
+		}
+	}
+}
+
+// probabilisticCLV fits BG/NBD and Gamma-Gamma on the histories. The error
+// says why the fit cannot be used.
+func probabilisticCLV(histories []purchaseHistory, horizon float64) (func(purchaseHistory) clvPrediction, error) {
+	var repeat []purchaseHistory
+	for _, h := range histories {
+		if h.x > 0 {
+			repeat = append(repeat, h)
+		}
+	}
+	if len(repeat) < 10 {
+		return nil, fmt.Errorf("%d repeat buyers, at least 10 are needed", len(repeat))
+	}
+
+	// parameters are fitted in log space so they stay positive
+	bgnbd, _ := nelderMead(func(p []float64) float64 {
+		r, alpha, a, b := math.Exp(p[0]), math.Exp(p[1]), math.Exp(p[2]), math.Exp(p[3])
+		ll := 0.0
+		for _, h := range histories {
+			ll += bgnbdLogLikelihood(r, alpha, a, b, h)
+		}
+		return -ll
+	}, []float64{0, 0, 0, 0}, 2000)
+	r, alpha, a, b := math.Exp(bgnbd[0]), math.Exp(bgnbd[1]), math.Exp(bgnbd[2]), math.Exp(bgnbd[3])
+
+	gg, _ := nelderMead(func(p []float64) float64 {
+		pp, q, v := math.Exp(p[0]), math.Exp(p[1]), math.Exp(p[2])
+		ll := 0.0
+		for _, h := range repeat {
+			ll += gammaGammaLogLikelihood(pp, q, v, h)
+		}
+		return -ll
+	}, []float64{0, 0, 0}, 2000)
+	p, q, v := math.Exp(gg[0]), math.Exp(gg[1]), math.Exp(gg[2])
+
+	if anyInvalid(r, alpha, a, b, p, q, v) {
+		return nil, fmt.Errorf("the fit did not converge")
+	}
+	// the Gamma-Gamma expected value only exists for q > 1
+	if q <= 1 {
+		return nil, fmt.Errorf("the Gamma-Gamma fit has q = %.3g, its expected value needs q > 1", q)
+	}
+
+	return func(h purchaseHistory) clvPrediction {
+		c := clvPrediction{
+			purchases: bgnbdExpected(r, alpha, a, b, h, horizon),
+			avgValue:  p * v / (q - 1), // population mean for one-time buyers
+			model:     CLVProbabilistic,
+		}
+		if h.x > 0 {
+			x, m := spendHistory(h)
+			c.avgValue = p * (v + x*m) / (p*x + q - 1)
+		}
+		return c
+	}, nil
+}
+
+// spendHistory is what Gamma-Gamma is fitted and predicts on: the number of
+// transactions, each with a value, and their mean value.
+func spendHistory(h purchaseHistory) (x, m float64) {
+	return h.x + 1, h.avgValue
+}
+
+func anyInvalid(values ...float64) bool {
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return true
+		}
+	}
+	return false
+}
+
+func lgamma(x float64) float64 {
+	v, _ := math.Lgamma(x)
+	return v
+}
+
+// bgnbdLogLikelihood is the BG/NBD likelihood of one customer (Fader, Hardie
+// and Lee, 2005).
+func bgnbdLogLikelihood(r, alpha, a, b float64, h purchaseHistory) float64 {
+	a1 := lgamma(r+h.x) - lgamma(r) + r*math.Log(alpha)
+	a2 := lgamma(a+b) + lgamma(b+h.x) - lgamma(b) - lgamma(a+b+h.x)
+	a3 := -(r + h.x) * math.Log(alpha+h.T)
+	if h.x == 0 {
+		return a1 + a2 + a3
+	}
+	a4 := math.Log(a) - math.Log(b+h.x-1) - (r+h.x)*math.Log(alpha+h.tx)
+	return a1 + a2 + logSumExp(a3, a4)
+}
+
+func logSumExp(x, y float64) float64 {
+	m := math.Max(x, y)
+	return m + math.Log(math.Exp(x-m)+math.Exp(y-m))
+}
+
+// bgnbdExpected is the expected number of purchases in the next t weeks.
+func bgnbdExpected(r, alpha, a, b float64, h purchaseHistory, t float64) float64 {
+	z := t / (alpha + h.T + t)
+	hyp := hyp2f1(r+h.x, b+h.x, a+b+h.x-1, z)
+	numerator := (a + b + h.x - 1) / (a - 1) * (1 - math.Pow((alpha+h.T)/(alpha+h.T+t), r+h.x)*hyp)
+	denominator := 1.0
+	if h.x > 0 {
+		denominator += a / (b + h.x - 1) * math.Pow((alpha+h.T)/(alpha+h.tx), r+h.x)
+	}
+	return numerator / denominator
+}
+
+// hyp2f1 is the Gauss hypergeometric function for |z| < 1, by its series.
+func hyp2f1(a, b, c, z float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 0.0; k < 10000; k++ {
+		term *= (a + k) * (b + k) / ((c + k) * (k + 1)) * z
+		sum += term
+		if math.Abs(term) < 1e-14*math.Abs(sum) {
+			break
+		}
+	}
+	return sum
+}
+
+// gammaGammaLogLikelihood is the Gamma-Gamma spend likelihood of a repeat
+// customer (Fader and Hardie, 2013).
+func gammaGammaLogLikelihood(p, q, v float64, h purchaseHistory) float64 {
+	x, m := spendHistory(h)
+	return lgamma(p*x+q) - lgamma(p*x) - lgamma(q) + q*math.Log(v) +
+		(p*x-1)*math.Log(m) + p*x*math.Log(x) - (p*x+q)*math.Log(x*m+v)
+}
+
+// nelderMead minimizes f from x0 with the downhill simplex method.
+func nelderMead(f func([]float64) float64, x0 []float64, iterations int) ([]float64, float64) {
+	n := len(x0)
+	simplex := make([][]float64, n+1)
+	values := make([]float64, n+1)
+	for i := range simplex {
+		simplex[i] = append([]float64(nil), x0...)
+		if i > 0 {
+			simplex[i][i-1] += 0.5
+		}
+		values[i] = f(simplex[i])
+	}
+
+	point := func(from, to []float64, t float64) []float64 {
+		p := make([]float64, n)
+		for i := range p {
+			p[i] = from[i] + t*(to[i]-from[i])
+		}
+		return p
+	}
+
+	for it := 0; it < iterations; it++ {
+		sort.Sort(simplexByValue{simplex, values})
+		if math.Abs(values[n]-values[0]) < 1e-10*(math.Abs(values[0])+1e-10) {
+			break
+		}
+
+		centroid := make([]float64, n)
+		for _, p := range simplex[:n] {
+			for i := range centroid {
+				centroid[i] += p[i] / float64(n)
+			}
+		}
+
+		reflected := point(centroid, simplex[n], -1)
+		fr := f(reflected)
+		switch {
+		case fr < values[0]:
+			expanded := point(centroid, simplex[n], -2)
+			if fe := f(expanded); fe < fr {
+				simplex[n], values[n] = expanded, fe
+			} else {
+				simplex[n], values[n] = reflected, fr
+			}
+		case fr < values[n-1]:
+			simplex[n], values[n] = reflected, fr
+		default:
+			contracted := point(centroid, simplex[n], 0.5)
+			if fc := f(contracted); fc < values[n] {
+				simplex[n], values[n] = contracted, fc
+				continue
+			}
+			// shrink towards the best point
+			for i := 1; i <= n; i++ {
+				simplex[i] = point(simplex[0], simplex[i], 0.5)
+				values[i] = f(simplex[i])
+			}
+		}
+	}
+	sort.Sort(simplexByValue{simplex, values})
+	return simplex[0], values[0]
+}
+
+type simplexByValue struct {
+	points [][]float64
+	values []float64
+}
+
+func (s simplexByValue) Len() int           { return len(s.values) }
+func (s simplexByValue) Less(i, j int) bool { return s.values[i] < s.values[j] }
+func (s simplexByValue) Swap(i, j int) {
+	s.points[i], s.points[j] = s.points[j], s.points[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+
+// insertCLV replaces the content of the CustomerCLV table.
+func insertCLV(ctx context.Context, db *sql.DB, clv []CustomerCLV) error {
+	rows := make([][]interface{}, len(clv))
+	for i, c := range clv {
+		rows[i] = []interface{}{c.CustomerID, c.TotalSales, c.Purchases, c.PredictedPurchases, c.PredictedAvgValue, c.PredictedValue, string(c.Model)}
+	}
+	return replaceTable(ctx, db, `
+	CREATE TABLE IF NOT EXISTS CustomerCLV (
+		CustomerID INT PRIMARY KEY,
+		TotalSales DECIMAL(18,4),
+		Purchases INT,
+		PredictedPurchases DOUBLE,
+		PredictedAvgValue DECIMAL(18,4),
+		PredictedValue DECIMAL(18,4),
+		Model CHAR(16)
+	);`, "CustomerCLV",
+		[]string{"CustomerID", "TotalSales", "Purchases", "PredictedPurchases", "PredictedAvgValue", "PredictedValue", "Model"}, rows)
+}
@@ -0,0 +1,40 @@
+package customeranalysis
+
+import (
+	"math"
+	"testing"
+)
+
+// the BG/NBD parameters fitted on the CDNOW data by Fader, Hardie and Lee
+// (2005), "Counting Your Customers" the Easy Way.
+const cdnowR, cdnowAlpha, cdnowA, cdnowB = 0.243, 4.414, 0.793, 2.426
+
+func TestBGNBDLogLikelihood(t *testing.T) {
+	// the values of the closed form of the paper, equation (6)
+	tests := []struct {
+		x, tx, T float64
+		want     float64
+	}{
+		{2, 30.43, 38.86, -9.458606307066272},
+		{1, 1.71, 38.86, -4.46909327503259},
+		{0, 0, 38.86, -0.5547132764381585},
+	}
+	for _, tt := range tests {
+		h := purchaseHistory{x: tt.x, tx: tt.tx, T: tt.T}
+		got := bgnbdLogLikelihood(cdnowR, cdnowAlpha, cdnowA, cdnowB, h)
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("log-likelihood(x=%v, tx=%v, T=%v) = %v, want %v", tt.x, tt.tx, tt.T, got, tt.want)
+		}
+	}
+}
+
+func TestBGNBDExpected(t *testing.T) {
+	// the paper's example: a customer with 2 repeat purchases, the last at
+	// 30.43 weeks, observed for 38.86 weeks, is expected to make 1.226
+	// purchases in the next 39 weeks. a < 1 here.
+	h := purchaseHistory{x: 2, tx: 30.43, T: 38.86}
+	got := bgnbdExpected(cdnowR, cdnowAlpha, cdnowA, cdnowB, h, 39)
+	if math.Abs(got-1.226) > 5e-4 {
+		t.Errorf("expected purchases = %v, want 1.226", got)
+	}
+}
@@ -0,0 +1,167 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Cohort is the customers who signed up (Customer.InsertDate) in one month.
+type Cohort struct {
+	Month              string // 2006-01
+	Customers          int
+	Buyers             int // customers with at least one purchase
+	Revenue            Money
+	RevenuePerCustomer Money
+	// Retention has one cell per month since the signup month (index 0),
+	// up to the latest month in the data.
+	Retention []CohortCell
+}
+
+// CohortCell is the activity of a cohort in one month after its signup.
+type CohortCell struct {
+	MonthOffset     int
+	ActiveCustomers int     // customers with a purchase in that month
+	Retention       float64 // ActiveCustomers / Customers
+	Revenue         Money
+}
+
+func monthIndex(t time.Time) int {
+	return t.Year()*12 + int(t.Month()) - 1
+}
+
+func monthName(index int) string {
+	return fmt.Sprintf("%04d-%02d", index/12, index%12+1)
+}
+
+// computeCohorts groups the customers by signup month. Purchases dated before
+// the signup month of their customer count in the cohort revenue but in no
+// cell of the matrix.
+func computeCohorts(signups map[int]time.Time, events []CustomerEvent, contentPrices map[int]Money) []Cohort {
+	byMonth := make(map[int]*Cohort)
+	cohortOf := make(map[int]int)
+	last := -1
+	for customerID, signup := range signups {
+		month := monthIndex(signup)
+		c, ok := byMonth[month]
+		if !ok {
+			c = &Cohort{Month: monthName(month)}
+			byMonth[month] = c
+		}
+		c.Customers++
+		cohortOf[customerID] = month
+		last = max(last, month)
+	}
+	for _, e := range events {
+		last = max(last, monthIndex(e.EventDate))
+	}
+	for month, c := range byMonth {
+		for offset := 0; offset <= last-month; offset++ {
+			c.Retention = append(c.Retention, CohortCell{MonthOffset: offset})
+		}
+	}
+
+	type activity struct{ customerID, month int }
+	seen := make(map[activity]bool)
+	buyers := make(map[int]bool)
+	pricedEvents(events, contentPrices, func(e CustomerEvent, revenue Money) {
+		cohortMonth, ok := cohortOf[e.CustomerID]
+		if !ok {
+			return // customer missing from the Customer table
+		}
+		c := byMonth[cohortMonth]
+		c.Revenue += revenue
+		if !buyers[e.CustomerID] {
+			buyers[e.CustomerID] = true
+			c.Buyers++
+		}
+
+		offset := monthIndex(e.EventDate) - cohortMonth
+		if offset < 0 {
+			return
+		}
+		cell := &c.Retention[offset]
+		cell.Revenue += revenue
+		if a := (activity{e.CustomerID, monthIndex(e.EventDate)}); !seen[a] {
+			seen[a] = true
+			cell.ActiveCustomers++
+		}
+	})
+
+	cohorts := make([]Cohort, 0, len(byMonth))
+	for _, c := range byMonth {
+		c.RevenuePerCustomer = c.Revenue.Div(c.Customers)
+		for i := range c.Retention {
+			c.Retention[i].Retention = float64(c.Retention[i].ActiveCustomers) / float64(c.Customers)
+		}
+		cohorts = append(cohorts, *c)
+	}
+	sort.Slice(cohorts, func(i, j int) bool { return cohorts[i].Month < cohorts[j].Month })
+	return cohorts
+}
+
+// retentionMatrix is the wide form of the cohorts: one row per cohort, one
+// column per month since signup, holding the retention rate.
+func retentionMatrix(cohorts []Cohort) table {
+	t := table{Name: "CohortRetentionMatrix", Columns: []string{"Cohort", "Customers"}}
+	months := 0
+	for _, c := range cohorts {
+		months = max(months, len(c.Retention))
+	}
+	for i := 0; i < months; i++ {
+		t.Columns = append(t.Columns, fmt.Sprintf("M%d", i))
+	}
+	for _, c := range cohorts {
+		row := []interface{}{c.Month, c.Customers}
+		for i := 0; i < months; i++ {
+			if i < len(c.Retention) {
+				row = append(row, c.Retention[i].Retention)
+			} else {
+				row = append(row, "") // month not reached yet
+			}
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	return t
+}
+
+// insertCohorts replaces the content of the Cohorts and CohortRetention
+// tables. CohortRetention is the retention matrix, one row per cell.
+func insertCohorts(ctx context.Context, db *sql.DB, cohorts []Cohort) error {
+	cohortRows := make([][]interface{}, len(cohorts))
+	var retentionRows [][]interface{}
+	for i, c := range cohorts {
+		cohortRows[i] = []interface{}{c.Month, c.Customers, c.Buyers, c.Revenue, c.RevenuePerCustomer}
+		for _, cell := range c.Retention {
+			retentionRows = append(retentionRows, []interface{}{c.Month, cell.MonthOffset, cell.ActiveCustomers, cell.Retention, cell.Revenue})
+		}
+	}
+	return replaceTables(ctx, db, tableRows{
+		ddl: `
+	CREATE TABLE IF NOT EXISTS Cohorts (
+		Cohort CHAR(7) PRIMARY KEY,
+		Customers INT,
+		Buyers INT,
+		Revenue DECIMAL(18,4),
+		RevenuePerCustomer DECIMAL(18,4)
+	);`,
+		table:   "Cohorts",
+		columns: []string{"Cohort", "Customers", "Buyers", "Revenue", "RevenuePerCustomer"},
+		rows:    cohortRows,
+	}, tableRows{
+		ddl: `
+	CREATE TABLE IF NOT EXISTS CohortRetention (
+		Cohort CHAR(7),
+		MonthOffset INT,
+		ActiveCustomers INT,
+		Retention DOUBLE,
+		Revenue DECIMAL(18,4),
+		PRIMARY KEY (Cohort, MonthOffset)
+	);`,
+		table:   "CohortRetention",
+		columns: []string{"Cohort", "MonthOffset", "ActiveCustomers", "Retention", "Revenue"},
+		rows:    retentionRows,
+	})
+}
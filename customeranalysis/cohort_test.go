@@ -0,0 +1,59 @@
+package customeranalysis
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestComputeCohorts(t *testing.T) {
+	date := func(month time.Month, d int) time.Time { return time.Date(2023, month, d, 12, 0, 0, 0, time.UTC) }
+	signups := map[int]time.Time{
+		1: date(time.January, 5),
+		2: date(time.January, 20),
+		3: date(time.February, 3),
+		4: date(time.March, 10), // never buys
+	}
+	prices := map[int]Money{1: 100000}
+	events := []CustomerEvent{
+		{CustomerID: 1, ContentID: 1, Quantity: 1, EventDate: date(time.January, 6)},
+		{CustomerID: 1, ContentID: 1, Quantity: 2, EventDate: date(time.January, 25)}, // active once in January
+		{CustomerID: 1, ContentID: 1, Quantity: 1, EventDate: date(time.March, 1)},
+		{CustomerID: 2, ContentID: 1, Quantity: 1, EventDate: date(time.February, 2)},
+		{CustomerID: 3, ContentID: 1, Quantity: 1, EventDate: date(time.January, 31)}, // before the signup
+		{CustomerID: 3, ContentID: 1, Quantity: 3, EventDate: date(time.March, 15)},
+		{CustomerID: 2, ContentID: 9, Quantity: 1, EventDate: date(time.March, 2)}, // no price
+		{CustomerID: 5, ContentID: 1, Quantity: 1, EventDate: date(time.March, 3)}, // not in Customer
+	}
+	want := []Cohort{
+		{Month: "2023-01", Customers: 2, Buyers: 2, Revenue: 500000, RevenuePerCustomer: 250000, Retention: []CohortCell{
+			{MonthOffset: 0, ActiveCustomers: 1, Retention: 0.5, Revenue: 300000},
+			{MonthOffset: 1, ActiveCustomers: 1, Retention: 0.5, Revenue: 100000},
+			{MonthOffset: 2, ActiveCustomers: 1, Retention: 0.5, Revenue: 100000},
+		}},
+		{Month: "2023-02", Customers: 1, Buyers: 1, Revenue: 400000, RevenuePerCustomer: 400000, Retention: []CohortCell{
+			{MonthOffset: 0},
+			{MonthOffset: 1, ActiveCustomers: 1, Retention: 1, Revenue: 300000},
+		}},
+		{Month: "2023-03", Customers: 1, Retention: []CohortCell{
+			{MonthOffset: 0},
+		}},
+	}
+	got := computeCohorts(signups, events, prices)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("computeCohorts =\n%+v\nwant\n%+v", got, want)
+	}
+
+	matrix := retentionMatrix(got)
+	if wantColumns := []string{"Cohort", "Customers", "M0", "M1", "M2"}; !reflect.DeepEqual(matrix.Columns, wantColumns) {
+		t.Errorf("matrix columns = %v, want %v", matrix.Columns, wantColumns)
+	}
+	wantRows := [][]interface{}{
+		{"2023-01", 2, 0.5, 0.5, 0.5},
+		{"2023-02", 1, 0.0, 1.0, ""},
+		{"2023-03", 1, 0.0, "", ""},
+	}
+	if !reflect.DeepEqual(matrix.Rows, wantRows) {
+		t.Errorf("matrix rows = %v, want %v", matrix.Rows, wantRows)
+	}
+}
@@ -0,0 +1,183 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// RankShare is the revenue made by one 2.5% rank quantile of Quantilesdata.
+type RankShare struct {
+	QuantileRange     string
+	NumberOfCustomers int
+	Revenue           Money
+	RevenueShare      float64 // share of the total revenue
+	CumulativeShare   float64 // share made by this quantile and the ones above
+}
+
+// ParetoFigure reads "CustomerShare of the customers make RevenueShare of
+// the revenue", counting from the best customers.
+type ParetoFigure struct {
+	CustomerShare float64
+	RevenueShare  float64
+}
+
+// Concentration tells how concentrated revenue is among customers.
+type Concentration struct {
+	TotalRevenue Money
+	// Gini is 0 when every customer spends the same and tends to 1 when a
+	// single customer makes all the revenue.
+	Gini float64
+	// Herfindahl is the sum of the squared revenue shares of the customers,
+	// between 1/customers and 1.
+	Herfindahl float64
+	RankShares []RankShare
+	// TopCustomers is the revenue made by the top 1, 5, 10, 20 and 50% of
+	// customers, TopRevenue the customers needed for 50, 80 and 90% of it.
+	TopCustomers []ParetoFigure
+	TopRevenue   []ParetoFigure
+}
+
+var (
+	paretoCustomerShares = []float64{0.01, 0.05, 0.10, 0.20, 0.50}
+	paretoRevenueShares  = []float64{0.50, 0.80, 0.90}
+)
+
+// computeConcentration works on customers sorted by decreasing TotalSales.
+func computeConcentration(customers []Customer) Concentration {
+	var c Concentration
+	n := len(customers)
+	for _, customer := range customers {
+		c.TotalRevenue += customer.TotalSales
+	}
+	if n == 0 || c.TotalRevenue == 0 {
+		return c
+	}
+
+	// Gini on ascending values: sum of (2i - n - 1) x_i / (n * total)
+	var weighted float64
+	for i, customer := range customers {
+		rank := n - i // ascending rank, from 1
+		weighted += float64(2*rank-n-1) * float64(customer.TotalSales)
+		share := customer.TotalSales.Ratio(c.TotalRevenue)
+		c.Herfindahl += share * share
+	}
+	c.Gini = weighted / (float64(n) * float64(c.TotalRevenue))
+
+	quantileSize := rankQuantileSize(n)
+	for i, customer := range customers {
+		index := rankQuantileIndex(i, quantileSize)
+		if index == len(c.RankShares) {
+			c.RankShares = append(c.RankShares, RankShare{QuantileRange: rankQuantileRange(index)})
+		}
+		c.RankShares[index].NumberOfCustomers++
+		c.RankShares[index].Revenue += customer.TotalSales
+	}
+	var cumulative Money
+	for i := range c.RankShares {
+		share := &c.RankShares[i]
+		cumulative += share.Revenue
+		share.RevenueShare = share.Revenue.Ratio(c.TotalRevenue)
+		share.CumulativeShare = cumulative.Ratio(c.TotalRevenue)
+	}
+
+	// revenue made by the top X% of customers
+	for _, customerShare := range paretoCustomerShares {
+		top := int(customerShare*float64(n) + 0.5)
+		top = max(1, min(top, n))
+		var revenue Money
+		for _, customer := range customers[:top] {
+			revenue += customer.TotalSales
+		}
+		c.TopCustomers = append(c.TopCustomers, ParetoFigure{CustomerShare: customerShare, RevenueShare: revenue.Ratio(c.TotalRevenue)})
+	}
+
+	// customers needed to reach Y% of the revenue
+	for _, revenueShare := range paretoRevenueShares {
+		var revenue Money
+		needed := n
+		for i, customer := range customers {
+			revenue += customer.TotalSales
+			if revenue.Ratio(c.TotalRevenue) >= revenueShare {
+				needed = i + 1
+				break
+			}
+		}
+		c.TopRevenue = append(c.TopRevenue, ParetoFigure{CustomerShare: float64(needed) / float64(n), RevenueShare: revenueShare})
+	}
+	return c
+}
+
+func (f ParetoFigure) String() string {
+	return fmt.Sprintf("%.1f%% of customers make %.1f%% of revenue", 100*f.CustomerShare, 100*f.RevenueShare)
+}
+
+// metricRow is one row of the ConcentrationMetrics table. Value is a
+// float64 ratio or a Money amount.
+type metricRow struct {
+	Metric      string
+	Value       interface{}
+	Description string
+}
+
+// cells puts ratios in the Value column and amounts in the DECIMAL Amount
+// column, leaving the other one NULL.
+func (m metricRow) cells() []interface{} {
+	if amount, ok := m.Value.(Money); ok {
+		return []interface{}{m.Metric, nil, amount, m.Description}
+	}
+	return []interface{}{m.Metric, m.Value, nil, m.Description}
+}
+
+func (c Concentration) metrics() []metricRow {
+	rows := []metricRow{
+		{"TotalRevenue", c.TotalRevenue, "sum of TotalSales"},
+		{"Gini", c.Gini, "0 = even split, 1 = one customer makes everything"},
+		{"Herfindahl", c.Herfindahl, "sum of squared customer revenue shares"},
+	}
+	for _, f := range c.TopCustomers {
+		rows = append(rows, metricRow{fmt.Sprintf("RevenueShareTop%gPct", 100*f.CustomerShare), f.RevenueShare, f.String()})
+	}
+	for _, f := range c.TopRevenue {
+		rows = append(rows, metricRow{fmt.Sprintf("CustomerShareFor%gPctRevenue", 100*f.RevenueShare), f.CustomerShare, f.String()})
+	}
+	return rows
+}
+
+// insertConcentration replaces the content of the ConcentrationMetrics and
+// RevenueShareByRank tables.
+func insertConcentration(ctx context.Context, db *sql.DB, c Concentration) error {
+	var metricRows, shareRows [][]interface{}
+	for _, m := range c.metrics() {
+		metricRows = append(metricRows, m.cells())
+	}
+	for _, r := range c.RankShares {
+		shareRows = append(shareRows, []interface{}{r.QuantileRange, r.NumberOfCustomers, r.Revenue, r.RevenueShare, r.CumulativeShare})
+	}
+	return replaceTables(ctx, db, tableRows{
+		ddl: `
+	CREATE TABLE IF NOT EXISTS ConcentrationMetrics (
+		ID INT AUTO_INCREMENT PRIMARY KEY,
+		Metric CHAR(64),
+		Value DOUBLE,
+		Amount DECIMAL(18,4),
+		Description CHAR(255)
+	);`,
+		table:   "ConcentrationMetrics",
+		columns: []string{"Metric", "Value", "Amount", "Description"},
+		rows:    metricRows,
+	}, tableRows{
+		ddl: `
+	CREATE TABLE IF NOT EXISTS RevenueShareByRank (
+		ID INT AUTO_INCREMENT PRIMARY KEY,
+		QuantileRange CHAR(50),
+		NumberOfCustomers INT,
+		Revenue DECIMAL(18,4),
+		RevenueShare DOUBLE,
+		CumulativeShare DOUBLE
+	);`,
+		table:   "RevenueShareByRank",
+		columns: []string{"QuantileRange", "NumberOfCustomers", "Revenue", "RevenueShare", "CumulativeShare"},
+		rows:    shareRows,
+	})
+}
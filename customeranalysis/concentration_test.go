@@ -0,0 +1,126 @@
+package customeranalysis
+
+import (
+	"math"
+	"testing"
+)
+
+// customersWithSales are customers 1, 2, ... with the given TotalSales, in
+// that order.
+func customersWithSales(sales ...Money) []Customer {
+	customers := make([]Customer, len(sales))
+	for i, s := range sales {
+		customers[i] = Customer{CustomerID: i + 1, TotalSales: s}
+	}
+	return customers
+}
+
+func TestComputeConcentration(t *testing.T) {
+	tests := []struct {
+		name       string
+		sales      []Money // decreasing
+		gini       float64
+		herfindahl float64
+		// revenue share of the top 1, 5, 10, 20 and 50% of customers
+		topCustomers []float64
+		// customer share needed for 50, 80 and 90% of the revenue
+		topRevenue []float64
+	}{
+		{
+			name:         "even",
+			sales:        []Money{100000, 100000, 100000, 100000},
+			gini:         0,
+			herfindahl:   4 * 0.25 * 0.25,
+			topCustomers: []float64{0.25, 0.25, 0.25, 0.25, 0.5},
+			topRevenue:   []float64{0.5, 1, 1},
+		},
+		{
+			// Gini = (2*4-4-1) * 100 / (4 * 100) = (n-1)/n
+			name:         "one customer makes everything",
+			sales:        []Money{1000000, 0, 0, 0},
+			gini:         0.75,
+			herfindahl:   1,
+			topCustomers: []float64{1, 1, 1, 1, 1},
+			topRevenue:   []float64{0.25, 0.25, 0.25},
+		},
+		{
+			// Gini = (2*60 + 0*30 - 2*10) / (3 * 100)
+			name:         "60 30 10",
+			sales:        []Money{600000, 300000, 100000},
+			gini:         1.0 / 3,
+			herfindahl:   0.36 + 0.09 + 0.01,
+			topCustomers: []float64{0.6, 0.6, 0.6, 0.6, 0.9},
+			topRevenue:   []float64{1.0 / 3, 2.0 / 3, 2.0 / 3},
+		},
+	}
+	for _, tt := range tests {
+		c := computeConcentration(customersWithSales(tt.sales...))
+		var total Money
+		for _, s := range tt.sales {
+			total += s
+		}
+		if c.TotalRevenue != total {
+			t.Errorf("%s: TotalRevenue = %v, want %v", tt.name, c.TotalRevenue, total)
+		}
+		if math.Abs(c.Gini-tt.gini) > 1e-12 {
+			t.Errorf("%s: Gini = %v, want %v", tt.name, c.Gini, tt.gini)
+		}
+		if math.Abs(c.Herfindahl-tt.herfindahl) > 1e-12 {
+			t.Errorf("%s: Herfindahl = %v, want %v", tt.name, c.Herfindahl, tt.herfindahl)
+		}
+		for i, f := range c.TopCustomers {
+			if math.Abs(f.RevenueShare-tt.topCustomers[i]) > 1e-12 {
+				t.Errorf("%s: top %v%% of customers make %v of revenue, want %v", tt.name, 100*f.CustomerShare, f.RevenueShare, tt.topCustomers[i])
+			}
+		}
+		for i, f := range c.TopRevenue {
+			if math.Abs(f.CustomerShare-tt.topRevenue[i]) > 1e-12 {
+				t.Errorf("%s: %v of customers needed for %v%% of revenue, want %v", tt.name, f.CustomerShare, 100*f.RevenueShare, tt.topRevenue[i])
+			}
+		}
+	}
+}
+
+func TestComputeConcentrationRankShares(t *testing.T) {
+	// under 40 customers, every customer has its own quantile
+	c := computeConcentration(customersWithSales(600000, 300000, 100000))
+	want := []RankShare{
+		{"0.000000% - 2.500000%", 1, 600000, 0.6, 0.6},
+		{"2.500000% - 5.000000%", 1, 300000, 0.3, 0.9},
+		{"5.000000% - 7.500000%", 1, 100000, 0.1, 1},
+	}
+	if len(c.RankShares) != len(want) {
+		t.Fatalf("got %d rank shares, want %d", len(c.RankShares), len(want))
+	}
+	for i, got := range c.RankShares {
+		w := want[i]
+		if got.QuantileRange != w.QuantileRange || got.NumberOfCustomers != w.NumberOfCustomers || got.Revenue != w.Revenue ||
+			math.Abs(got.RevenueShare-w.RevenueShare) > 1e-12 || math.Abs(got.CumulativeShare-w.CumulativeShare) > 1e-12 {
+			t.Errorf("rank share %d = %+v, want %+v", i, got, w)
+		}
+	}
+
+	// 80 customers: 40 quantiles of 2
+	sales := make([]Money, 80)
+	for i := range sales {
+		sales[i] = Money(80 - i)
+	}
+	c = computeConcentration(customersWithSales(sales...))
+	if len(c.RankShares) != 40 || c.RankShares[0].NumberOfCustomers != 2 || c.RankShares[0].Revenue != 80+79 {
+		t.Errorf("80 customers: %d rank shares, first %+v, want 40 of 2 customers, the first with 159", len(c.RankShares), c.RankShares[0])
+	}
+
+	if c := computeConcentration(nil); c.Gini != 0 || c.RankShares != nil || c.TopCustomers != nil {
+		t.Errorf("no customers: %+v, want nothing", c)
+	}
+}
+
+func TestConcentrationMetricCells(t *testing.T) {
+	rows := computeConcentration(customersWithSales(600000, 300000, 100000)).metrics()
+	if cells := rows[0].cells(); cells[0] != "TotalRevenue" || cells[1] != nil || cells[2] != Money(1000000) {
+		t.Errorf("TotalRevenue cells = %v, want the amount in the Amount column", cells)
+	}
+	if cells := rows[1].cells(); cells[0] != "Gini" || cells[1] != rows[1].Value || cells[2] != nil {
+		t.Errorf("Gini cells = %v, want the ratio in the Value column", cells)
+	}
+}
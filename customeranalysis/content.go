@@ -0,0 +1,149 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"TEST2024/database"
+)
+
+// ContentSales is what one content sold since PurchasesSince.
+type ContentSales struct {
+	ContentID       int
+	ClientContentID string
+	Revenue         Money
+	Units           int
+	Purchases       int
+	Buyers          int    // distinct customers
+	AvgPrice        Money  // revenue per unit
+	Rank            int    // 1 for the best revenue
+	QuantileRange   string // 2.5% rank quantile, as in Quantilesdata
+}
+
+// ContentQuantile is one 2.5% rank quantile of the contents.
+type ContentQuantile struct {
+	QuantileRange string
+	Contents      int
+	Revenue       Money
+	MaxRevenue    Money
+}
+
+func FetchContents(ctx context.Context, db *sql.DB) (map[int]string, error) {
+	query := `SELECT ContentID, ClientContentID FROM Content`
+	ctx, cancel := database.WithQueryTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, database.Classify("reading Content", err)
+	}
+	defer rows.Close()
+
+	contents := make(map[int]string)
+	for rows.Next() {
+		var contentID int
+		var clientContentID string
+		if err := rows.Scan(&contentID, &clientContentID); err != nil {
+			return nil, database.Classify("reading Content", err)
+		}
+		contents[contentID] = clientContentID
+	}
+	if err := rows.Err(); err != nil {
+		return nil, database.Classify("reading Content", err)
+	}
+	return contents, nil
+}
+
+// computeContentSales aggregates the purchases by content, best revenue
+// first, and splits the contents into the same 40 rank quantiles as the
+// customers.
+func computeContentSales(events []CustomerEvent, contentPrices map[int]Money, clientContentIDs map[int]string) ([]ContentSales, []ContentQuantile) {
+	byContent := make(map[int]*ContentSales)
+	type purchase struct{ contentID, customerID int }
+	buyers := make(map[purchase]bool)
+	pricedEvents(events, contentPrices, func(e CustomerEvent, revenue Money) {
+		c, exists := byContent[e.ContentID]
+		if !exists {
+			c = &ContentSales{ContentID: e.ContentID, ClientContentID: clientContentIDs[e.ContentID]}
+			byContent[e.ContentID] = c
+		}
+		c.Revenue += revenue
+		c.Units += e.Quantity
+		c.Purchases++
+		if p := (purchase{e.ContentID, e.CustomerID}); !buyers[p] {
+			buyers[p] = true
+			c.Buyers++
+		}
+	})
+
+	contents := make([]ContentSales, 0, len(byContent))
+	for _, c := range byContent {
+		c.AvgPrice = c.Revenue.Div(c.Units)
+		contents = append(contents, *c)
+	}
+	sort.Slice(contents, func(i, j int) bool {
+		if contents[i].Revenue != contents[j].Revenue {
+			return contents[i].Revenue > contents[j].Revenue
+		}
+		return contents[i].ContentID < contents[j].ContentID
+	})
+
+	var quantiles []ContentQuantile
+	quantileSize := rankQuantileSize(len(contents))
+	for i := range contents {
+		c := &contents[i]
+		c.Rank = i + 1
+		index := rankQuantileIndex(i, quantileSize)
+		c.QuantileRange = rankQuantileRange(index)
+		if index == len(quantiles) {
+			quantiles = append(quantiles, ContentQuantile{QuantileRange: c.QuantileRange})
+		}
+		q := &quantiles[index]
+		q.Contents++
+		q.Revenue += c.Revenue
+		q.MaxRevenue = max(q.MaxRevenue, c.Revenue)
+	}
+	return contents, quantiles
+}
+
+// insertContentSales replaces the content of the ContentSales and
+// ContentQuantiles tables.
+func insertContentSales(ctx context.Context, db *sql.DB, contents []ContentSales, quantiles []ContentQuantile) error {
+	contentRows := make([][]interface{}, len(contents))
+	for i, c := range contents {
+		contentRows[i] = []interface{}{c.ContentID, c.ClientContentID, c.Revenue, c.Units, c.Purchases, c.Buyers, c.AvgPrice, c.Rank, c.QuantileRange}
+	}
+	quantileRows := make([][]interface{}, len(quantiles))
+	for i, q := range quantiles {
+		quantileRows[i] = []interface{}{q.QuantileRange, q.Contents, q.Revenue, q.MaxRevenue}
+	}
+	return replaceTables(ctx, db, tableRows{
+		ddl: `
+	CREATE TABLE IF NOT EXISTS ContentSales (
+		ContentID INT PRIMARY KEY,
+		ClientContentID CHAR(64),
+		Revenue DECIMAL(18,4),
+		Units INT,
+		Purchases INT,
+		Buyers INT,
+		AvgPrice DECIMAL(18,4),
+		ContentRank INT,
+		QuantileRange CHAR(50)
+	);`,
+		table:   "ContentSales",
+		columns: []string{"ContentID", "ClientContentID", "Revenue", "Units", "Purchases", "Buyers", "AvgPrice", "ContentRank", "QuantileRange"},
+		rows:    contentRows,
+	}, tableRows{
+		ddl: `
+	CREATE TABLE IF NOT EXISTS ContentQuantiles (
+		ID INT AUTO_INCREMENT PRIMARY KEY,
+		QuantileRange CHAR(50),
+		Contents INT,
+		Revenue DECIMAL(18,4),
+		MaxRevenue DECIMAL(18,4)
+	);`,
+		table:   "ContentQuantiles",
+		columns: []string{"QuantileRange", "Contents", "Revenue", "MaxRevenue"},
+		rows:    quantileRows,
+	})
+}
@@ -0,0 +1,38 @@
+package customeranalysis
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestComputeContentSales(t *testing.T) {
+	prices := map[int]Money{1: 33333, 2: 100000, 3: 100000}
+	clientIDs := map[int]string{1: "A", 2: "B", 3: "C"}
+	events := []CustomerEvent{
+		{CustomerID: 1, ContentID: 1, Quantity: 2},
+		{CustomerID: 2, ContentID: 1, Quantity: 1},
+		{CustomerID: 1, ContentID: 2, Quantity: 1},
+		{CustomerID: 1, ContentID: 2, Quantity: 1},
+		{CustomerID: 3, ContentID: 3, Quantity: 2},
+		{CustomerID: 3, ContentID: 9, Quantity: 5}, // no price
+	}
+	contents, quantiles := computeContentSales(events, prices, clientIDs)
+
+	// 2 and 3 both make 20, the lower ContentID ranks first
+	want := []ContentSales{
+		{ContentID: 2, ClientContentID: "B", Revenue: 200000, Units: 2, Purchases: 2, Buyers: 1, AvgPrice: 100000, Rank: 1, QuantileRange: "0.000000% - 2.500000%"},
+		{ContentID: 3, ClientContentID: "C", Revenue: 200000, Units: 2, Purchases: 1, Buyers: 1, AvgPrice: 100000, Rank: 2, QuantileRange: "2.500000% - 5.000000%"},
+		{ContentID: 1, ClientContentID: "A", Revenue: 99999, Units: 3, Purchases: 2, Buyers: 2, AvgPrice: 33333, Rank: 3, QuantileRange: "5.000000% - 7.500000%"},
+	}
+	if !reflect.DeepEqual(contents, want) {
+		t.Errorf("computeContentSales =\n%+v\nwant\n%+v", contents, want)
+	}
+	wantQuantiles := []ContentQuantile{
+		{QuantileRange: "0.000000% - 2.500000%", Contents: 1, Revenue: 200000, MaxRevenue: 200000},
+		{QuantileRange: "2.500000% - 5.000000%", Contents: 1, Revenue: 200000, MaxRevenue: 200000},
+		{QuantileRange: "5.000000% - 7.500000%", Contents: 1, Revenue: 99999, MaxRevenue: 99999},
+	}
+	if !reflect.DeepEqual(quantiles, wantQuantiles) {
+		t.Errorf("content quantiles =\n%+v\nwant\n%+v", quantiles, wantQuantiles)
+	}
+}
@@ -0,0 +1,364 @@
+package customeranalysis
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"TEST2024/apperr"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// ExportFormat is a file format of FileSink.
+type ExportFormat string
+
+const (
+	ExportCSV   ExportFormat = "csv"
+	ExportJSON  ExportFormat = "json"
+	ExportJSONL ExportFormat = "jsonl"
+	ExportXLSX  ExportFormat = "xlsx"
+)
+
+// table is one result set, as written to files.
+type table struct {
+	Name    string
+	Columns []string
+	Rows    [][]interface{}
+}
+
+// tables lists the results in the order they are exported.
+func (r Results) tables() []table {
+	top := table{Name: "TopCustomers", Columns: []string{"Rank", "CustomerID", "Information", "TotalSales"}}
+	for i, c := range r.TopCustomers {
+		top.Rows = append(top.Rows, []interface{}{i + 1, c.CustomerID, c.Information, c.TotalSales})
+	}
+
+	above := table{Name: "AboveAverageCustomers", Columns: []string{"CustomerID", "TotalSales"}}
+	for _, c := range r.AboveAverage {
+		above.Rows = append(above.Rows, []interface{}{c.CustomerID, c.TotalSales})
+	}
+
+	summary := table{Name: "Summary", Columns: []string{"Name", "Value"}, Rows: [][]interface{}{
+		{"RunDate", r.RunDate},
+		{"Customers", len(r.Customers)},
+		{"TopCustomers", len(r.TopCustomers)},
+		{"AboveAverageCustomers", len(r.AboveAverage)},
+		{"AverageSales", r.AverageSales},
+	}}
+
+	metrics := table{Name: "ConcentrationMetrics", Columns: []string{"Metric", "Value", "Amount", "Description"}}
+	for _, m := range r.Concentration.metrics() {
+		metrics.Rows = append(metrics.Rows, m.cells())
+	}
+
+	shares := table{Name: "RevenueShareByRank", Columns: []string{"QuantileRange", "NumberOfCustomers", "Revenue", "RevenueShare", "CumulativeShare"}}
+	for _, s := range r.Concentration.RankShares {
+		shares.Rows = append(shares.Rows, []interface{}{s.QuantileRange, s.NumberOfCustomers, s.Revenue, s.RevenueShare, s.CumulativeShare})
+	}
+
+	rfm := table{Name: "CustomerRFM", Columns: []string{"CustomerID", "LastPurchase", "RecencyDays", "Frequency", "Monetary", "R", "F", "M", "RFMScore", "Segment"}}
+	for _, c := range r.RFM {
+		rfm.Rows = append(rfm.Rows, []interface{}{c.CustomerID, c.LastPurchase, c.RecencyDays, c.Frequency, c.Monetary, c.R, c.F, c.M, c.Score(), c.Segment})
+	}
+
+	segments := table{Name: "RFMSegments", Columns: []string{"Segment", "Customers", "AvgRecencyDays", "AvgFrequency", "AvgMonetary", "Revenue", "RevenueShare"}}
+	for _, s := range r.RFMSegments {
+		segments.Rows = append(segments.Rows, []interface{}{s.Segment, s.Customers, s.AvgRecencyDays, s.AvgFrequency, s.AvgMonetary, s.Revenue, s.RevenueShare})
+	}
+
+	clv := table{Name: "CustomerCLV", Columns: []string{"CustomerID", "TotalSales", "Purchases", "PredictedPurchases", "PredictedAvgValue", "PredictedValue", "Model"}}
+	for _, c := range r.CLV {
+		clv.Rows = append(clv.Rows, []interface{}{c.CustomerID, c.TotalSales, c.Purchases, c.PredictedPurchases, c.PredictedAvgValue, c.PredictedValue, string(c.Model)})
+	}
+
+	cohorts := table{Name: "Cohorts", Columns: []string{"Cohort", "Customers", "Buyers", "Revenue", "RevenuePerCustomer"}}
+	retention := table{Name: "CohortRetention", Columns: []string{"Cohort", "MonthOffset", "ActiveCustomers", "Retention", "Revenue"}}
+	for _, c := range r.Cohorts {
+		cohorts.Rows = append(cohorts.Rows, []interface{}{c.Month, c.Customers, c.Buyers, c.Revenue, c.RevenuePerCustomer})
+		for _, cell := range c.Retention {
+			retention.Rows = append(retention.Rows, []interface{}{c.Month, cell.MonthOffset, cell.ActiveCustomers, cell.Retention, cell.Revenue})
+		}
+	}
+
+	funnel := table{Name: "FunnelSteps", Columns: []string{"ContentID", "Step", "EventTypeID", "Customers", "StepConversion", "OverallConversion", "MedianHours"}}
+	for _, s := range r.Funnel {
+		funnel.Rows = append(funnel.Rows, []interface{}{s.ContentID, s.Step, s.EventTypeID, s.Customers, s.StepConversion, s.OverallConversion, s.MedianHours})
+	}
+
+	contents := table{Name: "ContentSales", Columns: []string{"ContentID", "ClientContentID", "Revenue", "Units", "Purchases", "Buyers", "AvgPrice", "ContentRank", "QuantileRange"}}
+	for _, c := range r.Contents {
+		contents.Rows = append(contents.Rows, []interface{}{c.ContentID, c.ClientContentID, c.Revenue, c.Units, c.Purchases, c.Buyers, c.AvgPrice, c.Rank, c.QuantileRange})
+	}
+
+	contentRanks := table{Name: "ContentQuantiles", Columns: []string{"QuantileRange", "Contents", "Revenue", "MaxRevenue"}}
+	for _, q := range r.ContentRanks {
+		contentRanks.Rows = append(contentRanks.Rows, []interface{}{q.QuantileRange, q.Contents, q.Revenue, q.MaxRevenue})
+	}
+
+	rules := table{Name: "AssociationRules", Columns: []string{"AntecedentContentID", "ConsequentContentID", "Baskets", "Support", "Confidence", "Lift"}}
+	for _, rule := range r.BasketRules {
+		rules.Rows = append(rules.Rows, []interface{}{rule.Antecedent, rule.Consequent, rule.Baskets, rule.Support, rule.Confidence, rule.Lift})
+	}
+
+	series := table{Name: "SalesTimeSeries", Columns: []string{"Granularity", "SplitBy", "Segment", "Period", "Revenue", "Units", "Orders", "ActiveCustomers", "RevenueMovingAvg", "RevenueGrowth"}}
+	for _, p := range r.Series {
+		series.Rows = append(series.Rows, []interface{}{string(r.SeriesConfig.Granularity), string(r.SeriesConfig.Split), p.Segment, p.Period.Format("2006-01-02"), p.Revenue, p.Units, p.Orders, p.ActiveCustomers, p.RevenueMA, p.RevenueGrowth})
+	}
+
+	forecasts := table{Name: "SalesForecast", Columns: []string{"Series", "Model", "ForecastDate", "Forecast", "LowerBound", "UpperBound"}}
+	for _, p := range r.Forecasts {
+		forecasts.Rows = append(forecasts.Rows, []interface{}{p.Series, string(p.Model), p.Date.Format("2006-01-02"), p.Forecast, p.Lower, p.Upper})
+	}
+
+	churn := table{Name: "ChurnRisk", Columns: []string{"RiskRank", "CustomerID", "Information", "TotalSales", "Reasons", "RecentPurchases", "ExpectedPurchases", "TopStreak"}}
+	for _, c := range r.ChurnRisks {
+		churn.Rows = append(churn.Rows, []interface{}{c.Rank, c.CustomerID, c.Information, c.TotalSales, strings.Join(c.Reasons, "; "), c.RecentPurchases, c.ExpectedPurchases, c.TopStreak})
+	}
+
+	anomalies := table{Name: "AnomalyReview", Columns: []string{"EventDataID", "CustomerID", "ContentID", "EventDate", "Quantity", "Value", "Score", "Reasons", "ExcludedFromRanking"}}
+	for _, a := range r.Anomalies {
+		anomalies.Rows = append(anomalies.Rows, []interface{}{a.EventDataID, a.CustomerID, a.ContentID, a.EventDate, a.Quantity, a.Value, a.Score, strings.Join(a.Reasons, "; "), r.AnomaliesOut})
+	}
+
+	tables := []table{
+		summary,
+		top,
+		quantileTable("Quantilesdata", r.RankQuantiles),
+		quantileTable("Quantiles_BY_CA", r.SalesQuantiles),
+		above,
+		metrics,
+		shares,
+	}
+	if r.SalesOnly {
+		return tables
+	}
+	return append(tables,
+		rfm,
+		segments,
+		clv,
+		cohorts,
+		retention,
+		retentionMatrix(r.Cohorts),
+		funnel,
+		contents,
+		contentRanks,
+		rules,
+		series,
+		forecasts,
+		churn,
+		anomalies,
+	)
+}
+
+func quantileTable(name string, quantiles []Quantile) table {
+	t := table{Name: name, Columns: []string{"QuantileRange", "NumberOfCustomers", "MaxSales"}}
+	for _, q := range quantiles {
+		t.Rows = append(t.Rows, []interface{}{q.QuantileRange, q.NumberOfCustomers, q.MaxSales})
+	}
+	return t
+}
+
+// FileSink writes the results to files. When Path is a directory every
+// table gets its own file named after it; JSON, JSONL and XLSX can also put
+// all the tables in the single file Path (one key, record kind or sheet per
+// table).
+type FileSink struct {
+	Path   string
+	Format ExportFormat
+	Dir    bool
+}
+
+// NewFileSink picks the format from the extension of path when format is
+// empty. A path without a known extension is a directory.
+func NewFileSink(path string, format string) (FileSink, error) {
+	ext := ExportFormat(strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."))
+	sink := FileSink{Path: path, Format: ExportFormat(format)}
+	if !validExportFormat(ext) {
+		sink.Dir = true
+	}
+	if sink.Format == "" {
+		if sink.Dir {
+			return sink, apperr.Errorf(apperr.Config, "cannot guess the format of %s, use csv, json, jsonl or xlsx", path)
+		}
+		sink.Format = ext
+	}
+	if !validExportFormat(sink.Format) {
+		return sink, apperr.Errorf(apperr.Config, "unknown export format %q (want csv, json, jsonl or xlsx)", sink.Format)
+	}
+	if !sink.Dir && ext != sink.Format {
+		return sink, apperr.Errorf(apperr.Config, "%s does not match the format %s", path, sink.Format)
+	}
+	if !sink.Dir && sink.Format == ExportCSV {
+		return sink, apperr.Errorf(apperr.Config, "csv needs a directory, one file per table")
+	}
+	return sink, nil
+}
+
+func validExportFormat(f ExportFormat) bool {
+	switch f {
+	case ExportCSV, ExportJSON, ExportJSONL, ExportXLSX:
+		return true
+	}
+	return false
+}
+
+func (s FileSink) Write(ctx context.Context, results Results) error {
+	return writeTables(s, results.tables())
+}
+
+func writeTables(s FileSink, tables []table) error {
+	if !s.Dir {
+		return writeFile(s.Path, s.Format, tables)
+	}
+	if err := os.MkdirAll(s.Path, 0o755); err != nil {
+		return err
+	}
+	for _, t := range tables {
+		path := filepath.Join(s.Path, t.Name+"."+string(s.Format))
+		if err := writeFile(path, s.Format, []table{t}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile writes tables to one file. A JSON or JSONL file holding a single
+// table is just its rows.
+func writeFile(path string, format ExportFormat, tables []table) error {
+	if format == ExportXLSX {
+		return writeXLSX(path, tables)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	switch format {
+	case ExportCSV:
+		err = writeCSV(w, tables[0])
+	case ExportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if len(tables) == 1 {
+			err = enc.Encode(tables[0].objects())
+		} else {
+			all := make(map[string][]map[string]interface{})
+			for _, t := range tables {
+				all[t.Name] = t.objects()
+			}
+			err = enc.Encode(all)
+		}
+	case ExportJSONL:
+		enc := json.NewEncoder(w)
+		for _, t := range tables {
+			for _, object := range t.objects() {
+				if len(tables) > 1 {
+					object["table"] = t.Name
+				}
+				if err = enc.Encode(object); err != nil {
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (t table) objects() []map[string]interface{} {
+	objects := make([]map[string]interface{}, 0, len(t.Rows))
+	for _, row := range t.Rows {
+		object := make(map[string]interface{}, len(t.Columns))
+		for i, column := range t.Columns {
+			object[column] = row[i]
+		}
+		objects = append(objects, object)
+	}
+	return objects
+}
+
+func writeCSV(w *bufio.Writer, t table) error {
+	cw := csv.NewWriter(w)
+	cw.Write(t.Columns)
+	record := make([]string, len(t.Columns))
+	for _, row := range t.Rows {
+		for i, value := range row {
+			record[i] = formatValue(value)
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// writeXLSX writes one sheet per table, with the column names on the first row.
+func writeXLSX(path string, tables []table) error {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	for i, t := range tables {
+		sheet := t.Name
+		if len(sheet) > 31 {
+			sheet = sheet[:31] // Excel limit
+		}
+		if i == 0 {
+			f.SetSheetName("Sheet1", sheet)
+		} else if _, err := f.NewSheet(sheet); err != nil {
+			return err
+		}
+
+		header := make([]interface{}, len(t.Columns))
+		for j, column := range t.Columns {
+			header[j] = column
+		}
+		if err := f.SetSheetRow(sheet, "A1", &header); err != nil {
+			return err
+		}
+		for j, row := range t.Rows {
+			cells := make([]interface{}, len(row))
+			for k, value := range row {
+				switch v := value.(type) {
+				case time.Time:
+					value = v.Format(time.RFC3339)
+				case Money:
+					value = v.Float64() // a number cell, not ten-thousandths
+				}
+				cells[k] = value
+			}
+			cell, _ := excelize.CoordinatesToCellName(1, j+2)
+			if err := f.SetSheetRow(sheet, cell, &cells); err != nil {
+				return err
+			}
+		}
+	}
+	return f.SaveAs(path)
+}
@@ -0,0 +1,307 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ForecastModel is a daily revenue forecasting method.
+type ForecastModel string
+
+const (
+	// HoltWinters is additive triple exponential smoothing, its smoothing
+	// parameters fitted on the one-step-ahead errors.
+	HoltWinters ForecastModel = "holt-winters"
+	// SeasonalNaive repeats the last observed season.
+	SeasonalNaive ForecastModel = "seasonal-naive"
+)
+
+// ForecastConfig configures the forecasts of the daily revenue.
+type ForecastConfig struct {
+	Horizon     int // days forecast after the last purchase
+	Season      int // days in a season, 7 for a weekly pattern
+	TopContents int // contents forecast on their own, best revenue first
+	Level       float64
+}
+
+// ForecastPoint is the forecast revenue of one series on one day.
+type ForecastPoint struct {
+	Series   string // "total" or a ContentID
+	Model    ForecastModel
+	Date     time.Time
+	Forecast Money
+	Lower    Money // bounds of the Level prediction interval
+	Upper    Money
+}
+
+// BacktestResult is the error of a model forecasting the last Horizon days
+// of a series from the days before.
+type BacktestResult struct {
+	Series string
+	Model  ForecastModel
+	Days   int
+	MAPE   float64 // over the days with revenue
+	RMSE   float64
+}
+
+// dailySeries is a revenue series without gaps, one value per day from Start.
+type dailySeries struct {
+	Name   string
+	Start  time.Time
+	Values []float64
+}
+
+// forecastSeries returns the daily revenue of all the contents, then of the
+// top contents.
+func forecastSeries(data SalesData, contents []ContentSales, cfg ForecastConfig) []dailySeries {
+	daily := TimeSeriesConfig{Granularity: Daily, Split: SplitNone}
+	all := []dailySeries{toDailySeries("total", computeTimeSeries(data.Events, data.ContentPrices, nil, daily))}
+	if len(all[0].Values) == 0 {
+		return nil
+	}
+
+	// per-content series share the dates of the total one
+	daily.Split = SplitContent
+	byContent := make(map[string][]SalesPeriod)
+	for _, p := range computeTimeSeries(data.Events, data.ContentPrices, nil, daily) {
+		byContent[p.Segment] = append(byContent[p.Segment], p)
+	}
+	for _, c := range contents[:min(cfg.TopContents, len(contents))] {
+		s := dailySeries{Name: strconv.Itoa(c.ContentID), Start: all[0].Start, Values: make([]float64, len(all[0].Values))}
+		for _, p := range byContent[s.Name] {
+			s.Values[int(p.Period.Sub(s.Start).Hours()/24+0.5)] = p.Revenue.Float64()
+		}
+		all = append(all, s)
+	}
+	return all
+}
+
+func toDailySeries(name string, periods []SalesPeriod) dailySeries {
+	s := dailySeries{Name: name}
+	for i, p := range periods {
+		if i == 0 {
+			s.Start = p.Period
+		}
+		s.Values = append(s.Values, p.Revenue.Float64())
+	}
+	return s
+}
+
+// computeForecasts forecasts every series with both models.
+func computeForecasts(series []dailySeries, cfg ForecastConfig) []ForecastPoint {
+	var points []ForecastPoint
+	for _, s := range series {
+		last := s.Start.AddDate(0, 0, len(s.Values)-1)
+		for _, model := range []ForecastModel{HoltWinters, SeasonalNaive} {
+			forecast, sigma, ok := forecastModel(model, s.Values, cfg)
+			if !ok {
+				continue
+			}
+			for h, f := range forecast {
+				width := normalQuantile(0.5+cfg.Level/2) * sigma[h]
+				points = append(points, ForecastPoint{
+					Series:   s.Name,
+					Model:    model,
+					Date:     last.AddDate(0, 0, h+1),
+					Forecast: MoneyFromFloat(math.Max(0, f)),
+					Lower:    MoneyFromFloat(math.Max(0, f-width)),
+					Upper:    MoneyFromFloat(math.Max(0, f+width)),
+				})
+			}
+		}
+	}
+	return points
+}
+
+// forecastModel returns the next cfg.Horizon values and the standard
+// deviation of their errors. ok is false when the series is too short.
+func forecastModel(model ForecastModel, values []float64, cfg ForecastConfig) (forecast, sigma []float64, ok bool) {
+	switch model {
+	case HoltWinters:
+		return holtWinters(values, cfg.Season, cfg.Horizon)
+	case SeasonalNaive:
+		return seasonalNaive(values, cfg.Season, cfg.Horizon)
+	}
+	return nil, nil, false
+}
+
+// seasonalNaive forecasts each day with the same day of the last season.
+// The error of one season ahead is estimated from the seasonal differences.
+func seasonalNaive(values []float64, m, horizon int) ([]float64, []float64, bool) {
+	n := len(values)
+	if m < 1 || n <= m {
+		return nil, nil, false
+	}
+	var sse float64
+	for t := m; t < n; t++ {
+		d := values[t] - values[t-m]
+		sse += d * d
+	}
+	s := math.Sqrt(sse / float64(n-m))
+
+	forecast := make([]float64, horizon)
+	sigma := make([]float64, horizon)
+	for h := 1; h <= horizon; h++ {
+		k := (h - 1) / m // whole seasons ahead
+		forecast[h-1] = values[n-m+(h-1)%m]
+		sigma[h-1] = s * math.Sqrt(float64(k+1))
+	}
+	return forecast, sigma, true
+}
+
+// hwState is the additive Holt-Winters state after the last observation.
+type hwState struct {
+	level, trend float64
+	seasonal     []float64 // the last m seasonal terms, oldest first
+	sse          float64   // sum of the squared one-step-ahead errors
+	errors       int
+}
+
+// runHoltWinters smooths values with the given parameters. The first
+// season initializes the level and the seasonal terms, the first two the
+// trend.
+func runHoltWinters(values []float64, m int, alpha, beta, gamma float64) hwState {
+	var first, second float64
+	for i := 0; i < m; i++ {
+		first += values[i] / float64(m)
+		second += values[m+i] / float64(m)
+	}
+	st := hwState{level: first, trend: (second - first) / float64(m)}
+	seasonal := make([]float64, len(values))
+	for i := 0; i < m; i++ {
+		seasonal[i] = values[i] - first
+	}
+
+	for t := m; t < len(values); t++ {
+		y := values[t]
+		e := y - (st.level + st.trend + seasonal[t-m])
+		st.sse += e * e
+		st.errors++
+		level := alpha*(y-seasonal[t-m]) + (1-alpha)*(st.level+st.trend)
+		st.trend = beta*(level-st.level) + (1-beta)*st.trend
+		seasonal[t] = gamma*(y-level) + (1-gamma)*seasonal[t-m]
+		st.level = level
+	}
+	st.seasonal = seasonal[len(values)-m:]
+	return st
+}
+
+func logistic(x float64) float64 { return 1 / (1 + math.Exp(-x)) }
+
+// holtWinters fits alpha, beta and gamma in (0, 1) by minimizing the
+// one-step-ahead squared errors, then forecasts. The interval widths use
+// the usual additive model variance.
+func holtWinters(values []float64, m, horizon int) ([]float64, []float64, bool) {
+	n := len(values)
+	if m < 1 || n < 2*m+1 {
+		return nil, nil, false
+	}
+	best, _ := nelderMead(func(p []float64) float64 {
+		return runHoltWinters(values, m, logistic(p[0]), logistic(p[1]), logistic(p[2])).sse
+	}, []float64{-1, -2, -2}, 500)
+	alpha, beta, gamma := logistic(best[0]), logistic(best[1]), logistic(best[2])
+	st := runHoltWinters(values, m, alpha, beta, gamma)
+	s2 := st.sse / float64(st.errors)
+
+	forecast := make([]float64, horizon)
+	sigma := make([]float64, horizon)
+	var variance float64 // sum of the squared psi weights
+	for h := 1; h <= horizon; h++ {
+		forecast[h-1] = st.level + float64(h)*st.trend + st.seasonal[(h-1)%m]
+		if j := h - 1; j > 0 {
+			psi := alpha + alpha*beta*float64(j)
+			if j%m == 0 {
+				psi += gamma * (1 - alpha)
+			}
+			variance += psi * psi
+		}
+		sigma[h-1] = math.Sqrt(s2 * (1 + variance))
+	}
+	return forecast, sigma, true
+}
+
+// normalQuantile inverts the standard normal distribution by bisection.
+func normalQuantile(p float64) float64 {
+	lo, hi := -10.0, 10.0
+	for i := 0; i < 100; i++ {
+		mid := (lo + hi) / 2
+		if 0.5*math.Erfc(-mid/math.Sqrt2) < p {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// backtest holds out the last cfg.Horizon days of every series, forecasts
+// them from the days before and measures the errors.
+func backtest(series []dailySeries, cfg ForecastConfig) []BacktestResult {
+	var results []BacktestResult
+	for _, s := range series {
+		n := len(s.Values) - cfg.Horizon
+		if n <= 0 {
+			continue
+		}
+		train, test := s.Values[:n], s.Values[n:]
+		for _, model := range []ForecastModel{HoltWinters, SeasonalNaive} {
+			forecast, _, ok := forecastModel(model, train, cfg)
+			if !ok {
+				continue
+			}
+			r := BacktestResult{Series: s.Name, Model: model, Days: len(test)}
+			var sse, ape float64
+			withRevenue := 0
+			for i, actual := range test {
+				f := math.Max(0, forecast[i])
+				sse += (actual - f) * (actual - f)
+				if actual != 0 {
+					ape += math.Abs(actual-f) / actual
+					withRevenue++
+				}
+			}
+			r.RMSE = math.Sqrt(sse / float64(len(test)))
+			if withRevenue > 0 {
+				r.MAPE = ape / float64(withRevenue)
+			}
+			results = append(results, r)
+		}
+	}
+	return results
+}
+
+// BacktestForecasts reads the purchases and backtests both forecasting
+// models on the total revenue and the top contents.
+func BacktestForecasts(ctx context.Context, db *sql.DB, opts Options) ([]BacktestResult, error) {
+	data, err := fetchCustomers(ctx, db, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Anomaly.Exclude {
+		data = withoutAnomalies(data, detectAnomalies(data.Events, data.ContentPrices, opts.Anomaly))
+	}
+	contents, _ := computeContentSales(data.Events, data.ContentPrices, data.Contents)
+	return backtest(forecastSeries(data, contents, opts.Forecast), opts.Forecast), nil
+}
+
+// insertForecasts replaces the content of the SalesForecast table.
+func insertForecasts(ctx context.Context, db *sql.DB, points []ForecastPoint) error {
+	rows := make([][]interface{}, len(points))
+	for i, p := range points {
+		rows[i] = []interface{}{p.Series, string(p.Model), p.Date.Format("2006-01-02"), p.Forecast, p.Lower, p.Upper}
+	}
+	return replaceTable(ctx, db, `
+	CREATE TABLE IF NOT EXISTS SalesForecast (
+		Series CHAR(32),
+		Model CHAR(16),
+		ForecastDate DATE,
+		Forecast DECIMAL(18,4),
+		LowerBound DECIMAL(18,4),
+		UpperBound DECIMAL(18,4),
+		PRIMARY KEY (Series, Model, ForecastDate)
+	);`, "SalesForecast",
+		[]string{"Series", "Model", "ForecastDate", "Forecast", "LowerBound", "UpperBound"}, rows)
+}
@@ -0,0 +1,79 @@
+package customeranalysis
+
+import (
+	"math"
+	"testing"
+)
+
+// weekly is a daily revenue with a weekly pattern, weekends higher, and a
+// trend of slope per day.
+func weekly(weeks int, slope float64) []float64 {
+	pattern := []float64{80, 90, 100, 95, 110, 160, 140}
+	values := make([]float64, 7*weeks)
+	for t := range values {
+		values[t] = pattern[t%7] + slope*float64(t)
+	}
+	return values
+}
+
+func TestSeasonalNaive(t *testing.T) {
+	values := weekly(4, 0)
+	forecast, sigma, ok := seasonalNaive(values, 7, 10)
+	if !ok {
+		t.Fatal("seasonalNaive did not forecast")
+	}
+	for h, f := range forecast {
+		if want := values[len(values)-7+h%7]; f != want {
+			t.Errorf("forecast[%d] = %v, want %v", h, f, want)
+		}
+		if sigma[h] != 0 {
+			t.Errorf("sigma[%d] = %v, want 0 on an exactly seasonal series", h, sigma[h])
+		}
+	}
+
+	// one more season ahead widens the interval by sqrt(2)
+	trend := weekly(4, 1)
+	forecast, sigma, _ = seasonalNaive(trend, 7, 8)
+	if forecast[0] != trend[21] {
+		t.Errorf("forecast[0] with a trend = %v, want the value a season ago %v", forecast[0], trend[21])
+	}
+	if r := sigma[7] / sigma[0]; math.Abs(r-math.Sqrt2) > 1e-12 {
+		t.Errorf("sigma[7] / sigma[0] = %v, want sqrt(2)", r)
+	}
+
+	if _, _, ok := seasonalNaive(values[:7], 7, 10); ok {
+		t.Error("seasonalNaive forecast a single season")
+	}
+}
+
+func TestHoltWinters(t *testing.T) {
+	// without a trend the first season starts the model exactly
+	values := weekly(6, 0)
+	forecast, sigma, ok := holtWinters(values, 7, 14)
+	if !ok {
+		t.Fatal("holtWinters did not forecast")
+	}
+	for h, f := range forecast {
+		if want := values[h%7]; math.Abs(f-want) > 1e-6 {
+			t.Errorf("forecast[%d] = %v, want %v", h, f, want)
+		}
+		if sigma[h] > 1e-6 {
+			t.Errorf("sigma[%d] = %v, want 0 on an exactly seasonal series", h, sigma[h])
+		}
+	}
+
+	// the trend is learnt from the data
+	const slope = 2
+	values = weekly(8, slope)
+	forecast, _, _ = holtWinters(values, 7, 14)
+	for h, f := range forecast {
+		n := len(values) + h
+		if want := weekly(1, 0)[n%7] + slope*float64(n); math.Abs(f-want) > 0.02*want {
+			t.Errorf("forecast[%d] with a trend = %v, want %v within 2%%", h, f, want)
+		}
+	}
+
+	if _, _, ok := holtWinters(values[:14], 7, 14); ok {
+		t.Error("holtWinters forecast two seasons, it needs one more day")
+	}
+}
@@ -0,0 +1,201 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"TEST2024/database"
+)
+
+// FunnelConfig is an ordered list of event types a customer goes through,
+// each step within Window of the first one.
+type FunnelConfig struct {
+	Steps  []int
+	Window time.Duration
+}
+
+// FunnelEvent is an event of any type, as read for the funnel.
+type FunnelEvent struct {
+	CustomerID  int
+	ContentID   int
+	EventTypeID int
+	EventDate   time.Time
+}
+
+// FunnelStep is the number of customers reaching one step of the funnel,
+// overall (ContentID 0) or on a single content.
+type FunnelStep struct {
+	ContentID   int
+	Step        int // from 1
+	EventTypeID int
+	Customers   int
+	// StepConversion is Customers over the customers of the previous step,
+	// OverallConversion over the customers of the first step.
+	StepConversion    float64
+	OverallConversion float64
+	// MedianHours is the median time from the previous step, 0 on step 1.
+	MedianHours float64
+}
+
+// FetchFunnelEvents reads the events of the given types since PurchasesSince.
+func FetchFunnelEvents(ctx context.Context, db *sql.DB, eventTypes []int) ([]FunnelEvent, error) {
+	if len(eventTypes) == 0 {
+		return nil, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(eventTypes)), ",")
+	args := []interface{}{PurchasesSince}
+	for _, t := range eventTypes {
+		args = append(args, t)
+	}
+	query := fmt.Sprintf(`
+	SELECT CustomerID, ContentID, EventTypeID, EventDate
+	FROM CustomerEventData
+	WHERE EventDate >= ? AND EventTypeID IN (%s)
+	`, placeholders)
+	ctx, cancel := database.WithQueryTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, database.Classify("reading CustomerEventData", err)
+	}
+	defer rows.Close()
+
+	var events []FunnelEvent
+	for rows.Next() {
+		var e FunnelEvent
+		if err := rows.Scan(&e.CustomerID, &e.ContentID, &e.EventTypeID, &e.EventDate); err != nil {
+			return nil, database.Classify("reading CustomerEventData", err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, database.Classify("reading CustomerEventData", err)
+	}
+	return events, nil
+}
+
+// computeFunnel returns the steps of the overall funnel followed by the
+// steps of every content, by ContentID.
+func computeFunnel(events []FunnelEvent, cfg FunnelConfig) []FunnelStep {
+	if len(cfg.Steps) == 0 {
+		return nil
+	}
+	sorted := append([]FunnelEvent(nil), events...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].EventDate.Before(sorted[j].EventDate) })
+
+	// events of each customer, overall and by content, in time order
+	type key struct{ contentID, customerID int }
+	paths := make(map[key][]FunnelEvent)
+	for _, e := range sorted {
+		paths[key{0, e.CustomerID}] = append(paths[key{0, e.CustomerID}], e)
+		paths[key{e.ContentID, e.CustomerID}] = append(paths[key{e.ContentID, e.CustomerID}], e)
+	}
+
+	// reached[content][step] counts customers, gaps the times from the previous step
+	reached := make(map[int][]int)
+	gaps := make(map[int][][]float64)
+	for k, path := range paths {
+		if _, ok := reached[k.contentID]; !ok {
+			reached[k.contentID] = make([]int, len(cfg.Steps))
+			gaps[k.contentID] = make([][]float64, len(cfg.Steps))
+		}
+		times := bestFunnelPath(path, cfg)
+		for step, t := range times {
+			reached[k.contentID][step]++
+			if step > 0 {
+				gaps[k.contentID][step] = append(gaps[k.contentID][step], t.Sub(times[step-1]).Hours())
+			}
+		}
+	}
+
+	contents := make([]int, 0, len(reached))
+	for contentID := range reached {
+		contents = append(contents, contentID)
+	}
+	sort.Ints(contents)
+
+	var steps []FunnelStep
+	for _, contentID := range contents {
+		counts := reached[contentID]
+		for i, eventType := range cfg.Steps {
+			s := FunnelStep{ContentID: contentID, Step: i + 1, EventTypeID: eventType, Customers: counts[i]}
+			if i == 0 {
+				s.StepConversion = 1
+			} else if counts[i-1] > 0 {
+				s.StepConversion = float64(counts[i]) / float64(counts[i-1])
+			}
+			if counts[0] > 0 {
+				s.OverallConversion = float64(counts[i]) / float64(counts[0])
+			}
+			s.MedianHours = median(gaps[contentID][i])
+			steps = append(steps, s)
+		}
+	}
+	return steps
+}
+
+// bestFunnelPath tries every occurrence of the first step as a start and
+// follows the earliest next step each time, staying within the window. It
+// returns the step times of the attempt that goes the furthest, the first
+// one on ties.
+func bestFunnelPath(path []FunnelEvent, cfg FunnelConfig) []time.Time {
+	var best []time.Time
+	for i, start := range path {
+		if start.EventTypeID != cfg.Steps[0] {
+			continue
+		}
+		times := []time.Time{start.EventDate}
+		for _, e := range path[i+1:] {
+			if len(times) == len(cfg.Steps) || e.EventDate.Sub(start.EventDate) > cfg.Window {
+				break
+			}
+			if e.EventTypeID == cfg.Steps[len(times)] {
+				times = append(times, e.EventDate)
+			}
+		}
+		if len(times) > len(best) {
+			best = times
+		}
+		if len(best) == len(cfg.Steps) {
+			break
+		}
+	}
+	return best
+}
+
+func median(values []float64) float64 {
+	n := len(values)
+	if n == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// insertFunnel replaces the content of the FunnelSteps table.
+func insertFunnel(ctx context.Context, db *sql.DB, steps []FunnelStep) error {
+	rows := make([][]interface{}, len(steps))
+	for i, s := range steps {
+		rows[i] = []interface{}{s.ContentID, s.Step, s.EventTypeID, s.Customers, s.StepConversion, s.OverallConversion, s.MedianHours}
+	}
+	return replaceTable(ctx, db, `
+	CREATE TABLE IF NOT EXISTS FunnelSteps (
+		ContentID INT,
+		Step INT,
+		EventTypeID INT,
+		Customers INT,
+		StepConversion DOUBLE,
+		OverallConversion DOUBLE,
+		MedianHours DOUBLE,
+		PRIMARY KEY (ContentID, Step)
+	);`, "FunnelSteps",
+		[]string{"ContentID", "Step", "EventTypeID", "Customers", "StepConversion", "OverallConversion", "MedianHours"}, rows)
+}
@@ -0,0 +1,65 @@
+package customeranalysis
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestComputeFunnel(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	event := func(customerID, contentID, eventType, hours int) FunnelEvent {
+		return FunnelEvent{CustomerID: customerID, ContentID: contentID, EventTypeID: eventType, EventDate: t0.Add(time.Duration(hours) * time.Hour)}
+	}
+	events := []FunnelEvent{
+		// views, carts 1h later, buys 2h after that
+		event(1, 10, 2, 0), event(1, 10, 4, 1), event(1, 10, 6, 3),
+		// buys after the 24h window
+		event(2, 10, 2, 0), event(2, 10, 4, 2), event(2, 10, 6, 30),
+		// carts before viewing, so only the view counts
+		event(3, 20, 4, 0), event(3, 20, 2, 1), event(3, 20, 6, 2),
+		// the first view goes nowhere, the second one to a purchase
+		event(4, 10, 2, 0), event(4, 10, 2, 48), event(4, 10, 4, 49), event(4, 10, 6, 50),
+	}
+	// given out of order, as the funnel sorts them
+	events[0], events[len(events)-1] = events[len(events)-1], events[0]
+
+	got := computeFunnel(events, FunnelConfig{Steps: []int{2, 4, 6}, Window: 24 * time.Hour})
+	want := []FunnelStep{
+		// customers 1, 2 and 4 cart 1, 2 and 1 hours after viewing, 1 and 4
+		// buy 2 and 1 hours after carting
+		{ContentID: 0, Step: 1, EventTypeID: 2, Customers: 4, StepConversion: 1, OverallConversion: 1},
+		{ContentID: 0, Step: 2, EventTypeID: 4, Customers: 3, StepConversion: 0.75, OverallConversion: 0.75, MedianHours: 1},
+		{ContentID: 0, Step: 3, EventTypeID: 6, Customers: 2, StepConversion: 2.0 / 3, OverallConversion: 0.5, MedianHours: 1.5},
+		{ContentID: 10, Step: 1, EventTypeID: 2, Customers: 3, StepConversion: 1, OverallConversion: 1},
+		{ContentID: 10, Step: 2, EventTypeID: 4, Customers: 3, StepConversion: 1, OverallConversion: 1, MedianHours: 1},
+		{ContentID: 10, Step: 3, EventTypeID: 6, Customers: 2, StepConversion: 2.0 / 3, OverallConversion: 2.0 / 3, MedianHours: 1.5},
+		{ContentID: 20, Step: 1, EventTypeID: 2, Customers: 1, StepConversion: 1, OverallConversion: 1},
+		{ContentID: 20, Step: 2, EventTypeID: 4},
+		{ContentID: 20, Step: 3, EventTypeID: 6},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("computeFunnel =\n%+v\nwant\n%+v", got, want)
+	}
+
+	if steps := computeFunnel(events, FunnelConfig{Window: time.Hour}); steps != nil {
+		t.Errorf("computeFunnel without steps = %+v, want nothing", steps)
+	}
+}
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   float64
+	}{
+		{nil, 0},
+		{[]float64{3}, 3},
+		{[]float64{5, 1, 3}, 3},
+		{[]float64{4, 1, 3, 2}, 2.5},
+	}
+	for _, tt := range tests {
+		if got := median(tt.values); got != tt.want {
+			t.Errorf("median(%v) = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"TEST2024/apperr"
+	"TEST2024/database"
+)
+
+// Money is an amount in ten-thousandths, the scale of the DECIMAL(18,4)
+// columns. Rounding rules:
+//   - prices are read exactly from DECIMAL columns; other sources are
+//     rounded to 4 decimals, half away from zero
+//   - price x quantity and sums are exact
+//   - averages (Div) and model outputs (MoneyFromFloat) are rounded to 4
+//     decimals, half away from zero
+//   - the HTML report shows 2 decimals, half away from zero
+//
+// Ratios and shares stay float64.
+type Money int64
+
+const (
+	moneyDecimals = 4
+	moneyScale    = 10000
+)
+
+// moneyColumn is the SQL type of every money column.
+const moneyColumn = "DECIMAL(18,4)"
+
+// MoneyFromFloat rounds f to 4 decimals, half away from zero.
+func MoneyFromFloat(f float64) Money {
+	return Money(math.Round(f * moneyScale))
+}
+
+// ParseMoney reads a decimal number exactly, rounding digits after the
+// fourth decimal half away from zero.
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	digits := s
+	if negative || strings.HasPrefix(s, "+") {
+		digits = s[1:] // one sign only, "+-5" is invalid
+	}
+	whole, fraction, _ := strings.Cut(digits, ".")
+	if whole == "" && fraction == "" {
+		return 0, apperr.Errorf(apperr.DataQuality, "invalid amount %q", s)
+	}
+	if strings.ContainsAny(whole+fraction, "eE") {
+		// exponent notation: go through float64
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.Abs(f) >= math.MaxInt64/moneyScale {
+			return 0, apperr.Errorf(apperr.DataQuality, "invalid amount %q", s)
+		}
+		return MoneyFromFloat(f), nil
+	}
+
+	// ParseInt would accept the signs left in the digits
+	if strings.ContainsAny(whole+fraction, "+-") {
+		return 0, apperr.Errorf(apperr.DataQuality, "invalid amount %q", s)
+	}
+	var m int64
+	if whole != "" {
+		w, err := strconv.ParseInt(whole, 10, 64)
+		if err != nil || w > math.MaxInt64/moneyScale {
+			return 0, apperr.Errorf(apperr.DataQuality, "invalid amount %q", s)
+		}
+		m = w * moneyScale
+	}
+	roundUp := false
+	if len(fraction) > moneyDecimals {
+		roundUp = fraction[moneyDecimals] >= '5'
+		fraction = fraction[:moneyDecimals]
+	}
+	if fraction != "" {
+		f, err := strconv.ParseInt(fraction+strings.Repeat("0", moneyDecimals-len(fraction)), 10, 64)
+		if err != nil || f < 0 {
+			return 0, apperr.Errorf(apperr.DataQuality, "invalid amount %q", s)
+		}
+		m += f
+	}
+	if roundUp {
+		m++
+	}
+	if negative {
+		m = -m
+	}
+	return Money(m), nil
+}
+
+// Mul is the exact amount of quantity units.
+func (m Money) Mul(quantity int) Money {
+	return m * Money(quantity)
+}
+
+// Div rounds m / n half away from zero. Dividing by zero gives zero.
+func (m Money) Div(n int) Money {
+	if n == 0 {
+		return 0
+	}
+	q, r := m/Money(n), m%Money(n)
+	if 2*abs64(int64(r)) >= abs64(int64(n)) {
+		if (m < 0) != (n < 0) {
+			q--
+		} else {
+			q++
+		}
+	}
+	return q
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Ratio is m / total, 0 when total is zero.
+func (m Money) Ratio(total Money) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(m) / float64(total)
+}
+
+// Float64 is for models and ratios only, never for sums.
+func (m Money) Float64() float64 {
+	return float64(m) / moneyScale
+}
+
+// String has all 4 decimals, e.g. "12.3400".
+func (m Money) String() string {
+	return m.format(moneyDecimals)
+}
+
+// Round2 rounds to 2 decimals, half away from zero, for display.
+func (m Money) Round2() string {
+	return m.format(2)
+}
+
+func (m Money) format(decimals int) string {
+	unit := int64(math.Pow10(moneyDecimals - decimals))
+	v := int64(m)
+	sign := ""
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	v = (v + unit/2) / unit
+	scale := int64(math.Pow10(decimals))
+	if decimals == 0 {
+		return fmt.Sprintf("%s%d", sign, v)
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, v/scale, decimals, v%scale)
+}
+
+// Value stores the exact decimal text, so DECIMAL columns get no float
+// conversion.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// Scan reads a DECIMAL (as text) or a floating point column.
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+		return nil
+	case []byte:
+		parsed, err := ParseMoney(string(v))
+		*m = parsed
+		return err
+	case string:
+		parsed, err := ParseMoney(v)
+		*m = parsed
+		return err
+	case float64:
+		*m = MoneyFromFloat(v)
+		return nil
+	case float32:
+		*m = MoneyFromFloat(float64(v))
+		return nil
+	case int64:
+		*m = Money(v * moneyScale)
+		return nil
+	}
+	return apperr.Errorf(apperr.DataQuality, "cannot scan %T into Money", src)
+}
+
+// MarshalJSON writes the amount as a JSON number with 4 decimals.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON reads a JSON number, or a string holding one, exactly.
+// null leaves m unchanged, as for the other types.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	parsed, err := ParseMoney(strings.Trim(string(data), `"`))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// moneyColumns are the Money columns of the result tables. The daily top
+// customers tables, test_2024_YYYYMMDD, have theirs in TotalSales.
+var moneyColumns = map[string][]string{
+	"AboveAverageCustomers": {"TotalSales"},
+	"AnomalyReview":         {"Value"},
+	"ChurnRisk":             {"TotalSales"},
+	"CohortRetention":       {"Revenue"},
+	"Cohorts":               {"Revenue", "RevenuePerCustomer"},
+	"ConcentrationMetrics":  {"Amount"},
+	"ContentQuantiles":      {"Revenue", "MaxRevenue"},
+	"ContentSales":          {"Revenue", "AvgPrice"},
+	"CustomerCLV":           {"TotalSales", "PredictedAvgValue", "PredictedValue"},
+	"CustomerRFM":           {"Monetary"},
+	"Quantiles_BY_CA":       {"MaxSales"},
+	"Quantilesdata":         {"MaxSales"},
+	"RFMSegments":           {"AvgMonetary", "Revenue"},
+	"RevenueShareByRank":    {"Revenue"},
+	"SalesForecast":         {"Forecast", "LowerBound", "UpperBound"},
+	"SalesTimeSeries":       {"Revenue", "RevenueMovingAvg"},
+}
+
+// addedMoneyColumns are money columns added to a table after it was first
+// created, with the column they go after.
+var addedMoneyColumns = []struct{ table, column, after string }{
+	{"ConcentrationMetrics", "Amount", "Value"},
+}
+
+func isMoneyColumn(table, column string) bool {
+	if strings.HasPrefix(table, "test_2024_") {
+		return column == "TotalSales"
+	}
+	for _, c := range moneyColumns[table] {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateMoneyColumns turns the money columns of tables created before they
+// were DECIMAL(18,4) into it, and adds the addedMoneyColumns missing from
+// existing tables. information_schema is read first, so only the columns
+// still to convert are altered: once, and not at all on a database already
+// migrated.
+func migrateMoneyColumns(ctx context.Context, db *sql.DB) error {
+	for _, c := range addedMoneyColumns {
+		var columns, found int
+		err := database.ScanRow(ctx, db, `
+		SELECT COUNT(*), COALESCE(SUM(COLUMN_NAME = ?), 0)
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?
+		`, []interface{}{c.column, c.table}, &columns, &found)
+		if err != nil {
+			return database.Classify("reading the columns of "+c.table, err)
+		}
+		// a table not created yet gets the column from its DDL
+		if columns == 0 || found > 0 {
+			continue
+		}
+		_, err = database.Exec(ctx, db, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s AFTER %s", c.table, c.column, moneyColumn, c.after))
+		if err != nil {
+			return fmt.Errorf("error adding %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
+	queryCtx, cancel := database.WithQueryTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(queryCtx, `
+	SELECT TABLE_NAME, COLUMN_NAME
+	FROM information_schema.COLUMNS
+	WHERE TABLE_SCHEMA = DATABASE()
+	AND NOT (DATA_TYPE = 'decimal' AND NUMERIC_PRECISION = 18 AND NUMERIC_SCALE = 4)
+	`)
+	if err != nil {
+		return database.Classify("reading the money column types", err)
+	}
+	type column struct{ table, name string }
+	var pending []column
+	for rows.Next() {
+		var c column
+		if err := rows.Scan(&c.table, &c.name); err != nil {
+			rows.Close()
+			return database.Classify("reading the money column types", err)
+		}
+		if isMoneyColumn(c.table, c.name) {
+			pending = append(pending, c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return database.Classify("reading the money column types", err)
+	}
+	rows.Close()
+
+	for _, c := range pending {
+		_, err := database.Exec(ctx, db, fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s", c.table, c.name, moneyColumn))
+		if err != nil {
+			return fmt.Errorf("error changing %s.%s to %s: %w", c.table, c.name, moneyColumn, err)
+		}
+	}
+	return nil
+}
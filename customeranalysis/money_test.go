@@ -0,0 +1,105 @@
+package customeranalysis
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{"12.5", 125000},
+		{" 12.5 ", 125000},
+		{"+3", 30000},
+		{"-3.25", -32500},
+		{".5", 5000},
+		{"7.", 70000},
+		{"0.00004", 0},
+		{"0.00005", 1},
+		{"-0.00005", -1},
+		{"1.23456", 12346},
+		{"1.2e3", 12000000},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in)
+		if err != nil {
+			t.Errorf("ParseMoney(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMoney(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "-", ".", "+-5", "-+5", "--5", "1.-5", "5-", "1.2.3", "abc", "+-5e3", "NaN", "Inf", "1e20", "1e400"} {
+		if got, err := ParseMoney(in); err == nil {
+			t.Errorf("ParseMoney(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestMoneyDiv(t *testing.T) {
+	tests := []struct {
+		m    Money
+		n    int
+		want Money
+	}{
+		{100000, 4, 25000},
+		{10, 3, 3},
+		{10, 4, 3}, // 2.5 rounds away from zero
+		{-10, 4, -3},
+		{10, -4, -3},
+		{-10, -4, 3},
+		{11, 4, 3},
+		{5, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Div(tt.n); got != tt.want {
+			t.Errorf("%d.Div(%d) = %d, want %d", tt.m, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyRound2(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{0, "0.00"},
+		{125000, "12.50"},
+		{12345, "1.23"},
+		{12350, "1.24"},
+		{-12350, "-1.24"},
+		{99950, "10.00"},
+		{49, "0.00"},
+		{50, "0.01"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Round2(); got != tt.want {
+			t.Errorf("Money(%d).Round2() = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var row struct{ Price, Missing Money }
+	row.Missing = 7
+	if err := json.Unmarshal([]byte(`{"Price": 12.3456, "Missing": null}`), &row); err != nil {
+		t.Fatal(err)
+	}
+	if row.Price != 123456 || row.Missing != 7 {
+		t.Errorf("decoded %+v, want Price 123456 and Missing unchanged", row)
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"Price":12.3456,"Missing":0.0007}`; string(data) != want {
+		t.Errorf("encoded %s, want %s", data, want)
+	}
+	if err := json.Unmarshal([]byte(`{"Price": "abc"}`), &row); err == nil {
+		t.Error("decoded an invalid amount")
+	}
+}
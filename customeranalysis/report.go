@@ -0,0 +1,221 @@
+package customeranalysis
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+)
+
+// ReportSink renders the results as a self-contained HTML file: inline CSS
+// and SVG charts, no external assets.
+type ReportSink struct {
+	Path string
+}
+
+func (s ReportSink) Write(ctx context.Context, results Results) error {
+	f, err := os.Create(s.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := reportTemplate.Execute(f, newReportData(results)); err != nil {
+		return fmt.Errorf("rendering report: %w", err)
+	}
+	return f.Close()
+}
+
+// chart sizes, in SVG user units
+const (
+	chartWidth  = 760.0
+	chartHeight = 280.0
+	chartMargin = 40.0
+)
+
+type chartBar struct {
+	X, Y, Width, Height float64
+	Label               string
+	Count               int
+}
+
+type chartTick struct {
+	Pos   float64
+	Label string
+}
+
+type reportData struct {
+	Results
+	PurchasesSince string
+	Histogram      []chartBar
+	HistogramMax   int
+	Lorenz         string // SVG polyline points
+	LorenzTicks    []chartTick
+	CohortMonths   []int // column headers of the retention heatmap
+	Width          float64
+	Height         float64
+	Margin         float64
+}
+
+func newReportData(results Results) reportData {
+	data := reportData{
+		Results:        results,
+		PurchasesSince: PurchasesSince,
+		Width:          chartWidth,
+		Height:         chartHeight,
+		Margin:         chartMargin,
+	}
+
+	// sales histogram: one bar per Quantiles_BY_CA range
+	plotWidth := chartWidth - 2*chartMargin
+	plotHeight := chartHeight - 2*chartMargin
+	for _, q := range results.SalesQuantiles {
+		data.HistogramMax = max(data.HistogramMax, q.NumberOfCustomers)
+	}
+	if n := len(results.SalesQuantiles); n > 0 && data.HistogramMax > 0 {
+		barWidth := plotWidth / float64(n)
+		for i, q := range results.SalesQuantiles {
+			h := plotHeight * float64(q.NumberOfCustomers) / float64(data.HistogramMax)
+			data.Histogram = append(data.Histogram, chartBar{
+				X:      chartMargin + float64(i)*barWidth,
+				Y:      chartMargin + plotHeight - h,
+				Width:  barWidth * 0.9,
+				Height: h,
+				Label:  q.QuantileRange,
+				Count:  q.NumberOfCustomers,
+			})
+		}
+	}
+
+	// Lorenz curve: cumulative share of revenue against cumulative share of
+	// customers, from the smallest rank bucket to the largest
+	var points []string
+	for _, p := range lorenzPoints(results.Concentration) {
+		x := chartMargin + p[0]*plotWidth
+		y := chartMargin + plotHeight - p[1]*plotHeight
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	data.Lorenz = strings.Join(points, " ")
+	for i := 0; i <= 4; i++ {
+		data.LorenzTicks = append(data.LorenzTicks, chartTick{Pos: float64(i) / 4, Label: fmt.Sprintf("%d%%", i*25)})
+	}
+
+	for _, c := range results.Cohorts {
+		for len(data.CohortMonths) < len(c.Retention) {
+			data.CohortMonths = append(data.CohortMonths, len(data.CohortMonths))
+		}
+	}
+	return data
+}
+
+// heat colors a retention rate, from white (0) to the bar blue (1).
+func heat(v float64) template.CSS {
+	return template.CSS(fmt.Sprintf("background: rgba(74, 120, 181, %.2f)", min(1, max(0, v))))
+}
+
+// lorenzPoints returns (share of customers, share of revenue) pairs from the
+// rank quantiles, smallest buyers first, starting at (0, 0).
+func lorenzPoints(c Concentration) [][2]float64 {
+	points := [][2]float64{{0, 0}}
+	customers := 0
+	for _, s := range c.RankShares {
+		customers += s.NumberOfCustomers
+	}
+	if customers == 0 {
+		return points
+	}
+
+	seen, revenue := 0, 0.0
+	for i := len(c.RankShares) - 1; i >= 0; i-- {
+		seen += c.RankShares[i].NumberOfCustomers
+		revenue += c.RankShares[i].RevenueShare
+		points = append(points, [2]float64{float64(seen) / float64(customers), revenue})
+	}
+	return points
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"money": func(v Money) string { return v.Round2() },
+	"ratio": func(v float64) string { return fmt.Sprintf("%.3f", v) },
+	"add":   func(a, b float64) float64 { return a + b },
+	"sub":   func(a, b float64) float64 { return a - b },
+	"mul":   func(a, b float64) float64 { return a * b },
+	"inc":   func(i int) int { return i + 1 },
+	"dec":   func(i int) int { return i - 1 },
+	"pct":   func(v float64) string { return fmt.Sprintf("%.0f%%", 100*v) },
+	"heat":  heat,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Customer sales report {{.RunDate.Format "2006-01-02"}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 820px; color: #222; }
+h1, h2 { font-weight: normal; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: 4px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+svg text { font-size: 11px; fill: #555; }
+.bar { fill: #4a78b5; }
+.curve { fill: none; stroke: #c0392b; stroke-width: 2; }
+.axis, .equality { stroke: #999; stroke-width: 1; }
+.equality { stroke-dasharray: 4 4; }
+.heatmap td, .heatmap th { font-size: 11px; padding: 2px 4px; }
+</style>
+</head>
+<body>
+<h1>Customer sales report</h1>
+
+<h2>Run parameters</h2>
+<table>
+<tr><td>Run date</td><td>{{.RunDate.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><td>Purchases counted</td><td>event type 6 since {{.PurchasesSince}}</td></tr>
+<tr><td>Customers with purchases</td><td>{{len .Customers}}</td></tr>
+<tr><td>Top customers (2.5%)</td><td>{{len .TopCustomers}}</td></tr>
+<tr><td>Average sales</td><td>{{money .AverageSales}}</td></tr>
+<tr><td>Customers above average</td><td>{{len .AboveAverage}}</td></tr>
+</table>
+
+<h2>Sales distribution</h2>
+<p>Number of customers in each of the 40 sales ranges (Quantiles_BY_CA).</p>
+<svg width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+<line class="axis" x1="{{.Margin}}" y1="{{sub .Height .Margin}}" x2="{{sub .Width .Margin}}" y2="{{sub .Height .Margin}}"/>
+{{range .Histogram}}<rect class="bar" x="{{printf "%.1f" .X}}" y="{{printf "%.1f" .Y}}" width="{{printf "%.1f" .Width}}" height="{{printf "%.1f" .Height}}"><title>{{.Label}}: {{.Count}} customers</title></rect>
+{{end}}{{with .SalesQuantiles}}<text x="{{$.Margin}}" y="{{sub $.Height 20}}">{{(index . 0).QuantileRange}}</text>
+<text x="{{sub $.Width $.Margin}}" y="{{sub $.Height 20}}" text-anchor="end">{{(index . (len . | dec)).QuantileRange}}</text>{{end}}
+<text x="{{.Margin}}" y="{{sub .Margin 8}}">max {{.HistogramMax}} customers</text>
+</svg>
+
+<h2>Revenue concentration</h2>
+<p>Cumulative share of revenue against cumulative share of customers, from the smallest to the largest buyers (Lorenz curve). The dashed line is a perfectly even split.</p>
+<svg width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+<line class="axis" x1="{{.Margin}}" y1="{{sub .Height .Margin}}" x2="{{sub .Width .Margin}}" y2="{{sub .Height .Margin}}"/>
+<line class="axis" x1="{{.Margin}}" y1="{{.Margin}}" x2="{{.Margin}}" y2="{{sub .Height .Margin}}"/>
+<line class="equality" x1="{{.Margin}}" y1="{{sub .Height .Margin}}" x2="{{sub .Width .Margin}}" y2="{{.Margin}}"/>
+{{range .LorenzTicks}}<text x="{{add $.Margin (mul .Pos (sub $.Width (mul 2 $.Margin)))}}" y="{{sub $.Height 24}}" text-anchor="middle">{{.Label}}</text>
+<text x="{{sub $.Margin 6}}" y="{{sub (sub $.Height $.Margin) (mul .Pos (sub $.Height (mul 2 $.Margin)))}}" text-anchor="end">{{.Label}}</text>
+{{end}}<polyline class="curve" points="{{.Lorenz}}"/>
+</svg>
+<table>
+<tr><td>Gini coefficient</td><td>{{ratio .Concentration.Gini}}</td></tr>
+<tr><td>Herfindahl index</td><td>{{ratio .Concentration.Herfindahl}}</td></tr>
+{{range .Concentration.TopCustomers}}<tr><td colspan="2">{{.}}</td></tr>
+{{end}}{{range .Concentration.TopRevenue}}<tr><td colspan="2">{{.}}</td></tr>
+{{end}}</table>
+
+{{with .Cohorts}}<h2>Cohort retention</h2>
+<p>Share of each signup cohort (Customer.InsertDate month) purchasing in each month after signing up, M0 being the signup month.</p>
+<table class="heatmap">
+<tr><th>Cohort</th><th>Customers</th><th>Revenue</th>{{range $.CohortMonths}}<th>M{{.}}</th>{{end}}</tr>
+{{range .}}<tr><td>{{.Month}}</td><td>{{.Customers}}</td><td>{{money .Revenue}}</td>{{range .Retention}}<td style="{{heat .Retention}}">{{pct .Retention}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}
+<h2>Top customers</h2>
+<table>
+<tr><th>Rank</th><th>CustomerID</th><th>Information</th><th>Total sales</th></tr>
+{{range $i, $c := .TopCustomers}}<tr><td>{{inc $i}}</td><td>{{$c.CustomerID}}</td><td>{{$c.Information}}</td><td>{{money $c.TotalSales}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,256 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"TEST2024/database"
+)
+
+// Results holds everything the analysis computes from the sorted customers.
+type Results struct {
+	RunDate        time.Time
+	Customers      []Customer // every customer, by decreasing TotalSales
+	TopCustomers   []Customer // the top 2.5%
+	RankQuantiles  []Quantile // Quantilesdata
+	SalesQuantiles []Quantile // Quantiles_BY_CA
+	AboveAverage   []Customer
+	AverageSales   Money
+	Concentration  Concentration
+	RFM            []CustomerRFM
+	RFMSegments    []RFMSegment
+	CLV            []CustomerCLV
+	Cohorts        []Cohort       // by signup month
+	Funnel         []FunnelStep   // overall (ContentID 0), then by content
+	Contents       []ContentSales // by decreasing Revenue
+	ContentRanks   []ContentQuantile
+	BasketRules    []AssociationRule // best lift first
+	SeriesConfig   TimeSeriesConfig
+	Series         []SalesPeriod // by segment, then period
+	Forecasts      []ForecastPoint
+	ChurnRisks     []ChurnRisk // ranked
+	Anomalies      []AnomalousEvent
+	AnomaliesOut   bool // the anomalies were left out of the other results
+	// SalesOnly is set by streamed runs: only the results up to
+	// Concentration were computed, the event analyses are empty.
+	SalesOnly bool
+}
+
+// Options tunes the computations of an analysis run.
+type Options struct {
+	CLV      CLVConfig
+	Funnel   FunnelConfig
+	Basket   BasketConfig
+	Series   TimeSeriesConfig
+	Forecast ForecastConfig
+	Churn    ChurnConfig
+	Anomaly  AnomalyConfig
+	Stream   StreamConfig
+}
+
+// DefaultOptions predicts a 12-month value with BG/NBD and Gamma-Gamma and
+// follows the view, cart, purchase funnel over 7 days. It keeps the 100 best
+// co-purchase rules with 1% support and 10% confidence, and a daily sales
+// series with a 7-day moving average. Forecasts cover 30 days with 95%
+// intervals, for the total revenue and the 5 best contents. Customers are at
+// risk when buying less than a quarter of their usual rate over 30 days, or
+// when leaving the top after 3 days in it. Anomalies (robust z-score above
+// 3.5, or 10 purchases within an hour) are reviewed but kept in the ranking.
+func DefaultOptions() Options {
+	return Options{
+		CLV:      CLVConfig{Model: CLVProbabilistic, HorizonDays: 365, Retention: 1},
+		Funnel:   FunnelConfig{Steps: []int{2, 4, 6}, Window: 7 * 24 * time.Hour},
+		Basket:   BasketConfig{MinSupport: 0.01, MinConfidence: 0.1, TopRules: 100},
+		Series:   TimeSeriesConfig{Granularity: Daily, Split: SplitNone, MovingAverage: 7},
+		Forecast: ForecastConfig{Horizon: 30, Season: 7, TopContents: 5, Level: 0.95},
+		Churn:    ChurnConfig{RecentDays: 30, DropRatio: 0.25, MinPurchases: 3, TopDays: 3},
+		Anomaly:  AnomalyConfig{Threshold: 3.5, MinEvents: 5, BurstWindow: time.Hour, BurstEvents: 10},
+	}
+}
+
+// ComputeResults runs every computation of the analysis, without writing.
+// data.Customers must be sorted by decreasing TotalSales, like fetchCustomers does.
+// With opts.Stream.Enabled only the customer sales results are computed.
+func ComputeResults(data SalesData, opts Options) Results {
+	anomalies := detectAnomalies(data.Events, data.ContentPrices, opts.Anomaly)
+	if opts.Anomaly.Exclude {
+		data = withoutAnomalies(data, anomalies)
+	}
+
+	customers := data.Customers
+	results := Results{
+		RunDate:        time.Now(),
+		Customers:      customers,
+		RankQuantiles:  rankQuantiles(customers),
+		SalesQuantiles: salesQuantiles(customers),
+		Anomalies:      anomalies,
+		AnomaliesOut:   opts.Anomaly.Exclude,
+	}
+
+	// same rule as createAndPopulateCustomerTable: ranks 0 to 2.5% included
+	topPercent := int(float64(len(customers)) * 0.025)
+	results.TopCustomers = customers[:min(topPercent+1, len(customers))]
+
+	results.AboveAverage, results.AverageSales = aboveAverageCustomers(customers)
+	results.Concentration = computeConcentration(customers)
+	if opts.Stream.Enabled {
+		results.SalesOnly = true
+		return results
+	}
+	results.RFM = computeRFM(data.Events, data.ContentPrices)
+	results.RFMSegments = summarizeRFM(results.RFM)
+	results.CLV = computeCLV(data.Events, data.ContentPrices, opts.CLV)
+	results.Cohorts = computeCohorts(data.Signups, data.Events, data.ContentPrices)
+	results.Funnel = computeFunnel(data.FunnelEvents, opts.Funnel)
+	results.Contents, results.ContentRanks = computeContentSales(data.Events, data.ContentPrices, data.Contents)
+	results.BasketRules = computeBasketRules(data.Events, opts.Basket)
+	results.SeriesConfig = opts.Series
+	results.Series = computeTimeSeries(data.Events, data.ContentPrices, data.ChannelTypes, opts.Series)
+	results.Forecasts = computeForecasts(forecastSeries(data, results.Contents, opts.Forecast), opts.Forecast)
+	results.ChurnRisks = computeChurn(data.Events, customers, results.TopCustomers, data.TopHistory, opts.Churn)
+	return results
+}
+
+// Sink receives the results of an analysis run.
+type Sink interface {
+	Write(ctx context.Context, results Results) error
+}
+
+// DBSink writes the results to the MySQL tables: the daily top customers
+// table, Quantilesdata, Quantiles_BY_CA, AboveAverageCustomers,
+// ConcentrationMetrics, RevenueShareByRank, CustomerRFM, RFMSegments,
+// CustomerCLV, Cohorts, CohortRetention, FunnelSteps, ContentSales,
+// ContentQuantiles, AssociationRules, SalesTimeSeries, SalesForecast and
+// ChurnRisk and AnomalyReview. Results with SalesOnly stop after
+// RevenueShareByRank and leave the other tables as they are.
+//
+// The tables only depend on the results, so they are written as
+// concurrent stages, tuned by Runner.
+type DBSink struct {
+	DB     *sql.DB
+	Runner RunnerConfig
+}
+
+func (s DBSink) Write(ctx context.Context, results Results) error {
+	// MySQL commits on ALTER, so the migration runs before the stages
+	if err := migrateMoneyColumns(ctx, s.DB); err != nil {
+		return err
+	}
+	_, err := RunStages(ctx, s.Runner, s.stages(results))
+	return err
+}
+
+// stages has one stage per group of tables written together, with the
+// number of rows it inserts.
+func (s DBSink) stages(results Results) []Stage {
+	stages := []Stage{
+		{"TopCustomers", len(results.TopCustomers), func(ctx context.Context) error {
+			return createAndPopulateCustomerTable(ctx, s.DB, results.Customers)
+		}},
+		{"Quantilesdata", len(results.RankQuantiles), func(ctx context.Context) error {
+			return createAndPopulateQuantilesTable(ctx, s.DB, results.RankQuantiles)
+		}},
+		{"Quantiles_BY_CA", len(results.SalesQuantiles), func(ctx context.Context) error {
+			return quantileBYCA(ctx, s.DB, results.SalesQuantiles)
+		}},
+		{"AboveAverageCustomers", len(results.AboveAverage), func(ctx context.Context) error {
+			return insertAboveAverageCustomers(ctx, s.DB, results.AboveAverage)
+		}},
+		{"Concentration", len(results.Concentration.metrics()) + len(results.Concentration.RankShares), func(ctx context.Context) error {
+			return insertConcentration(ctx, s.DB, results.Concentration)
+		}},
+	}
+	if results.SalesOnly {
+		return stages
+	}
+	return append(stages, []Stage{
+		{"RFM", len(results.RFM) + len(results.RFMSegments), func(ctx context.Context) error {
+			return insertRFM(ctx, s.DB, results.RFM, results.RFMSegments)
+		}},
+		{"CLV", len(results.CLV), func(ctx context.Context) error { return insertCLV(ctx, s.DB, results.CLV) }},
+		{"Cohorts", cohortRows(results.Cohorts), func(ctx context.Context) error {
+			return insertCohorts(ctx, s.DB, results.Cohorts)
+		}},
+		{"Funnel", len(results.Funnel), func(ctx context.Context) error {
+			return insertFunnel(ctx, s.DB, results.Funnel)
+		}},
+		{"ContentSales", len(results.Contents) + len(results.ContentRanks), func(ctx context.Context) error {
+			return insertContentSales(ctx, s.DB, results.Contents, results.ContentRanks)
+		}},
+		{"AssociationRules", len(results.BasketRules), func(ctx context.Context) error {
+			return insertBasketRules(ctx, s.DB, results.BasketRules)
+		}},
+		{"SalesTimeSeries", len(results.Series), func(ctx context.Context) error {
+			return insertTimeSeries(ctx, s.DB, results.SeriesConfig, results.Series)
+		}},
+		{"SalesForecast", len(results.Forecasts), func(ctx context.Context) error {
+			return insertForecasts(ctx, s.DB, results.Forecasts)
+		}},
+		{"ChurnRisk", len(results.ChurnRisks), func(ctx context.Context) error {
+			return insertChurn(ctx, s.DB, results.ChurnRisks)
+		}},
+		{"AnomalyReview", len(results.Anomalies), func(ctx context.Context) error {
+			return insertAnomalies(ctx, s.DB, results.Anomalies, results.AnomaliesOut)
+		}},
+	}...)
+}
+
+// cohortRows is the rows of the Cohorts and CohortRetention tables.
+func cohortRows(cohorts []Cohort) int {
+	rows := len(cohorts)
+	for _, c := range cohorts {
+		rows += len(c.Retention)
+	}
+	return rows
+}
+
+// tableRows is the rows that replace the content of a results table.
+type tableRows struct {
+	ddl     string // CREATE TABLE IF NOT EXISTS
+	table   string
+	columns []string
+	rows    [][]interface{}
+	// where limits the rows replaced, with its args; all of them when empty
+	where     string
+	whereArgs []interface{}
+}
+
+// replaceTable creates table with ddl if needed, then replaces its rows in
+// a transaction: a DELETE, then one INSERT per row.
+func replaceTable(ctx context.Context, db *sql.DB, ddl, table string, columns []string, rows [][]interface{}) error {
+	return replaceTables(ctx, db, tableRows{ddl: ddl, table: table, columns: columns, rows: rows})
+}
+
+// replaceTables is replaceTable for tables read together, so they are
+// replaced in the same transaction.
+func replaceTables(ctx context.Context, db *sql.DB, tables ...tableRows) error {
+	for _, t := range tables {
+		if _, err := database.Exec(ctx, db, t.ddl); err != nil {
+			return fmt.Errorf("error creating %s table: %w", t.table, err)
+		}
+	}
+	return database.InTx(ctx, db, func(tx *sql.Tx) error {
+		for _, t := range tables {
+			query := "DELETE FROM " + t.table
+			if t.where != "" {
+				query += " WHERE " + t.where
+			}
+			if _, err := database.Exec(ctx, tx, query, t.whereArgs...); err != nil {
+				return fmt.Errorf("error clearing %s table: %w", t.table, err)
+			}
+		}
+		for _, t := range tables {
+			placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(t.columns)), ", ")
+			query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.table, strings.Join(t.columns, ", "), placeholders)
+			for i, row := range t.rows {
+				if _, err := database.Exec(ctx, tx, query, row...); err != nil {
+					return fmt.Errorf("error inserting row %d of %s: %w", i+1, t.table, err)
+				}
+			}
+		}
+		return nil
+	})
+}
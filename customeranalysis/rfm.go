@@ -0,0 +1,181 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// CustomerRFM scores a customer 1 (worst) to 5 (best) on recency, frequency
+// and monetary value, each score being the quintile of the customer among
+// all the buyers.
+type CustomerRFM struct {
+	CustomerID   int
+	LastPurchase time.Time
+	RecencyDays  int // days between the last purchase and the latest one in the data
+	Frequency    int // number of purchase events
+	Monetary     Money
+	R, F, M      int
+	Segment      string
+}
+
+// Score is the usual three digit RFM code, e.g. "545".
+func (c CustomerRFM) Score() string {
+	return fmt.Sprintf("%d%d%d", c.R, c.F, c.M)
+}
+
+// RFMSegment summarizes the customers of one segment.
+type RFMSegment struct {
+	Segment        string
+	Customers      int
+	AvgRecencyDays float64
+	AvgFrequency   float64
+	AvgMonetary    Money
+	Revenue        Money
+	RevenueShare   float64
+}
+
+// rfmSegments maps recency (rows) and frequency (columns) scores to the
+// segment names of the classic RFM grid.
+var rfmSegments = [5][5]string{
+	{"Hibernating", "Hibernating", "At Risk", "At Risk", "Can't Lose Them"},
+	{"Hibernating", "Hibernating", "At Risk", "At Risk", "Can't Lose Them"},
+	{"About To Sleep", "About To Sleep", "Need Attention", "Loyal Customers", "Loyal Customers"},
+	{"Promising", "Potential Loyalists", "Potential Loyalists", "Loyal Customers", "Loyal Customers"},
+	{"New Customers", "Potential Loyalists", "Potential Loyalists", "Champions", "Champions"},
+}
+
+// computeRFM scores every customer with at least one priced purchase.
+// Recency is measured from the latest purchase in the data, so old data sets
+// are scored the same way as fresh ones.
+func computeRFM(events []CustomerEvent, contentPrices map[int]Money) []CustomerRFM {
+	byCustomer := make(map[int]*CustomerRFM)
+	var latest time.Time
+	pricedEvents(events, contentPrices, func(e CustomerEvent, value Money) {
+		c, exists := byCustomer[e.CustomerID]
+		if !exists {
+			c = &CustomerRFM{CustomerID: e.CustomerID}
+			byCustomer[e.CustomerID] = c
+		}
+		c.Frequency++
+		c.Monetary += value
+		if e.EventDate.After(c.LastPurchase) {
+			c.LastPurchase = e.EventDate
+		}
+		if e.EventDate.After(latest) {
+			latest = e.EventDate
+		}
+	})
+
+	customers := make([]CustomerRFM, 0, len(byCustomer))
+	for _, c := range byCustomer {
+		c.RecencyDays = int(latest.Sub(c.LastPurchase).Hours() / 24)
+		customers = append(customers, *c)
+	}
+	sort.Slice(customers, func(i, j int) bool { return customers[i].CustomerID < customers[j].CustomerID })
+
+	recency := quintileScores(customers, func(c CustomerRFM) float64 { return -float64(c.RecencyDays) })
+	frequency := quintileScores(customers, func(c CustomerRFM) float64 { return float64(c.Frequency) })
+	monetary := quintileScores(customers, func(c CustomerRFM) float64 { return float64(c.Monetary) })
+	for i := range customers {
+		c := &customers[i]
+		c.R, c.F, c.M = recency[i], frequency[i], monetary[i]
+		c.Segment = rfmSegments[c.R-1][c.F-1]
+	}
+	return customers
+}
+
+// quintileScores gives each customer 1 + the quintile of the customers with a
+// strictly lower value, so equal values always get the same score.
+func quintileScores(customers []CustomerRFM, value func(CustomerRFM) float64) []int {
+	n := len(customers)
+	values := make([]float64, n)
+	for i, c := range customers {
+		values[i] = value(c)
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	scores := make([]int, n)
+	for i, v := range values {
+		below := sort.SearchFloat64s(sorted, v)
+		scores[i] = min(5, 1+5*below/n)
+	}
+	return scores
+}
+
+// summarizeRFM aggregates the customers by segment, biggest revenue first.
+func summarizeRFM(customers []CustomerRFM) []RFMSegment {
+	bySegment := make(map[string]*RFMSegment)
+	var total Money
+	for _, c := range customers {
+		s, ok := bySegment[c.Segment]
+		if !ok {
+			s = &RFMSegment{Segment: c.Segment}
+			bySegment[c.Segment] = s
+		}
+		s.Customers++
+		s.AvgRecencyDays += float64(c.RecencyDays)
+		s.AvgFrequency += float64(c.Frequency)
+		s.Revenue += c.Monetary
+		total += c.Monetary
+	}
+
+	segments := make([]RFMSegment, 0, len(bySegment))
+	for _, s := range bySegment {
+		n := float64(s.Customers)
+		s.AvgRecencyDays /= n
+		s.AvgFrequency /= n
+		s.AvgMonetary = s.Revenue.Div(s.Customers)
+		s.RevenueShare = s.Revenue.Ratio(total)
+		segments = append(segments, *s)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Revenue > segments[j].Revenue })
+	return segments
+}
+
+// insertRFM replaces the content of the CustomerRFM and RFMSegments tables.
+func insertRFM(ctx context.Context, db *sql.DB, customers []CustomerRFM, segments []RFMSegment) error {
+	customerRows := make([][]interface{}, len(customers))
+	for i, c := range customers {
+		customerRows[i] = []interface{}{c.CustomerID, c.LastPurchase, c.RecencyDays, c.Frequency, c.Monetary, c.R, c.F, c.M, c.Score(), c.Segment}
+	}
+	segmentRows := make([][]interface{}, len(segments))
+	for i, s := range segments {
+		segmentRows[i] = []interface{}{s.Segment, s.Customers, s.AvgRecencyDays, s.AvgFrequency, s.AvgMonetary, s.Revenue, s.RevenueShare}
+	}
+	return replaceTables(ctx, db, tableRows{
+		ddl: `
+	CREATE TABLE IF NOT EXISTS CustomerRFM (
+		CustomerID INT PRIMARY KEY,
+		LastPurchase DATETIME,
+		RecencyDays INT,
+		Frequency INT,
+		Monetary DECIMAL(18,4),
+		R TINYINT,
+		F TINYINT,
+		M TINYINT,
+		RFMScore CHAR(3),
+		Segment CHAR(32)
+	);`,
+		table:   "CustomerRFM",
+		columns: []string{"CustomerID", "LastPurchase", "RecencyDays", "Frequency", "Monetary", "R", "F", "M", "RFMScore", "Segment"},
+		rows:    customerRows,
+	}, tableRows{
+		ddl: `
+	CREATE TABLE IF NOT EXISTS RFMSegments (
+		Segment CHAR(32) PRIMARY KEY,
+		Customers INT,
+		AvgRecencyDays DOUBLE,
+		AvgFrequency DOUBLE,
+		AvgMonetary DECIMAL(18,4),
+		Revenue DECIMAL(18,4),
+		RevenueShare DOUBLE
+	);`,
+		table:   "RFMSegments",
+		columns: []string{"Segment", "Customers", "AvgRecencyDays", "AvgFrequency", "AvgMonetary", "Revenue", "RevenueShare"},
+		rows:    segmentRows,
+	})
+}
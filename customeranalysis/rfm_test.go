@@ -0,0 +1,78 @@
+package customeranalysis
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuintileScores(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   []int
+	}{
+		{[]float64{30, 10, 50, 20, 40}, []int{3, 1, 5, 2, 4}},
+		{[]float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, []int{1, 1, 2, 2, 3, 3, 4, 4, 5, 5}},
+		// equal values share the score of the lowest of them
+		{[]float64{10, 10, 20}, []int{1, 1, 4}},
+		{[]float64{5, 5, 5, 5}, []int{1, 1, 1, 1}},
+		{[]float64{7}, []int{1}},
+	}
+	for _, tt := range tests {
+		customers := make([]CustomerRFM, len(tt.values))
+		for i := range customers {
+			customers[i].CustomerID = i
+		}
+		got := quintileScores(customers, func(c CustomerRFM) float64 { return tt.values[c.CustomerID] })
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("quintileScores(%v) = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestComputeRFM(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2023, 1, d, 12, 0, 0, 0, time.UTC) }
+	prices := map[int]Money{1: 100000, 2: 50000}
+	events := []CustomerEvent{
+		{CustomerID: 1, ContentID: 1, Quantity: 1, EventDate: day(10)},
+		{CustomerID: 1, ContentID: 1, Quantity: 1, EventDate: day(20)},
+		{CustomerID: 1, ContentID: 1, Quantity: 1, EventDate: day(31)},
+		{CustomerID: 2, ContentID: 2, Quantity: 2, EventDate: day(1)},
+		{CustomerID: 3, ContentID: 1, Quantity: 5, EventDate: day(30)},
+		{CustomerID: 4, ContentID: 9, Quantity: 1, EventDate: day(31)}, // no price
+	}
+	// recency -0, -30, -1; frequency 3, 1, 1; monetary 30, 10, 50: with 3
+	// customers, 1 + 5*below/3 gives 1, 2 and 4
+	want := []CustomerRFM{
+		{CustomerID: 1, LastPurchase: day(31), RecencyDays: 0, Frequency: 3, Monetary: 300000, R: 4, F: 4, M: 2, Segment: "Loyal Customers"},
+		{CustomerID: 2, LastPurchase: day(1), RecencyDays: 30, Frequency: 1, Monetary: 100000, R: 1, F: 1, M: 1, Segment: "Hibernating"},
+		{CustomerID: 3, LastPurchase: day(30), RecencyDays: 1, Frequency: 1, Monetary: 500000, R: 2, F: 1, M: 4, Segment: "Hibernating"},
+	}
+	got := computeRFM(events, prices)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("computeRFM =\n%+v\nwant\n%+v", got, want)
+	}
+	if score := got[0].Score(); score != "442" {
+		t.Errorf("Score() = %q, want 442", score)
+	}
+
+	segments := summarizeRFM(got)
+	wantSegments := []RFMSegment{
+		{Segment: "Hibernating", Customers: 2, AvgRecencyDays: 15.5, AvgFrequency: 1, AvgMonetary: 300000, Revenue: 600000, RevenueShare: 2.0 / 3},
+		{Segment: "Loyal Customers", Customers: 1, AvgRecencyDays: 0, AvgFrequency: 3, AvgMonetary: 300000, Revenue: 300000, RevenueShare: 1.0 / 3},
+	}
+	if len(segments) != len(wantSegments) {
+		t.Fatalf("summarizeRFM = %+v, want %+v", segments, wantSegments)
+	}
+	for i, s := range segments {
+		w := wantSegments[i]
+		if math.Abs(s.RevenueShare-w.RevenueShare) > 1e-12 {
+			t.Errorf("segment %s RevenueShare = %v, want %v", s.Segment, s.RevenueShare, w.RevenueShare)
+		}
+		s.RevenueShare = w.RevenueShare
+		if s != w {
+			t.Errorf("segment %d = %+v, want %+v", i, s, w)
+		}
+	}
+}
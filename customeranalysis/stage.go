@@ -0,0 +1,154 @@
+package customeranalysis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"sync"
+	"time"
+
+	"TEST2024/database"
+	"TEST2024/metrics"
+)
+
+// Stage is one step of a run that does not depend on the other stages.
+type Stage struct {
+	Name string
+	Rows int // rows written, counted in metrics.Rows under Name when Run succeeds
+	Run  func(ctx context.Context) error
+}
+
+// StageResult is the outcome of one stage.
+type StageResult struct {
+	Name     string
+	Rows     int
+	Duration time.Duration
+	Err      error
+	Skipped  bool // not started because the run was cancelled
+}
+
+// Outcome is ok, failed or skipped.
+func (r StageResult) Outcome() string {
+	switch {
+	case r.Skipped:
+		return "skipped"
+	case r.Err != nil:
+		return "failed"
+	}
+	return "ok"
+}
+
+// StageError is the failure of one stage, as joined in the error of RunStages.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("stage %s: %v", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// RunnerConfig tunes RunStages.
+type RunnerConfig struct {
+	Workers int // stages running at once, 0 for GOMAXPROCS, 1 to run them in order
+	// FailFast cancels the run at the first failure: the stages not started
+	// yet are skipped and the running ones see their context cancelled.
+	FailFast bool
+	// OnDone, when set, is called after each stage, one call at a time.
+	OnDone func(StageResult)
+}
+
+// RunStages runs the stages on cfg.Workers goroutines, starting them in
+// order. A failed stage does not stop the others unless cfg.FailFast is set.
+// Every stage is logged and counted in the metrics package.
+// The results are in the order of stages; the error joins a *StageError per
+// failed stage, and the context error when ctx was cancelled.
+func RunStages(ctx context.Context, cfg RunnerConfig, stages []Stage) ([]StageResult, error) {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	results := make([]StageResult, len(stages))
+	next := make(chan int)
+	var done sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(stages)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = runStage(runCtx, stages[i])
+				recordStage(results[i], database.PlanFrom(ctx) != nil)
+				if results[i].Err != nil && !results[i].Skipped && cfg.FailFast {
+					cancel()
+				}
+				if cfg.OnDone != nil {
+					done.Lock()
+					cfg.OnDone(results[i])
+					done.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range stages {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil && !r.Skipped {
+			errs = append(errs, &StageError{Stage: r.Name, Err: r.Err})
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return results, errors.Join(errs...)
+}
+
+func runStage(ctx context.Context, stage Stage) (result StageResult) {
+	result.Name, result.Rows = stage.Name, stage.Rows
+	if err := ctx.Err(); err != nil {
+		result.Err, result.Skipped = err, true
+		return result
+	}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+		if r := recover(); r != nil {
+			result.Err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	result.Err = stage.Run(ctx)
+	return result
+}
+
+// recordStage logs r and counts it. The rows of a dry run are not counted
+// as written.
+func recordStage(r StageResult, dryRun bool) {
+	metrics.StageRuns.Add(1, r.Name, r.Outcome())
+	switch {
+	case r.Skipped:
+		slog.Warn("stage skipped", "stage", r.Name)
+		return
+	case r.Err != nil:
+		slog.Error("stage failed", "stage", r.Name, "duration", r.Duration, "error", r.Err)
+	default:
+		if !dryRun {
+			metrics.Rows.Add(float64(r.Rows), r.Name, "write")
+		}
+		slog.Info("stage done", "stage", r.Name, "rows", r.Rows, "duration", r.Duration)
+	}
+	metrics.StageDuration.Observe(r.Duration.Seconds(), r.Name)
+}
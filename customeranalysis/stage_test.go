@@ -0,0 +1,127 @@
+package customeranalysis
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+var errStage = errors.New("stage error")
+
+func TestRunStages(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	fail := func(ctx context.Context) error { return errStage }
+	tests := []struct {
+		name     string
+		cfg      RunnerConfig
+		stages   []Stage
+		outcomes []string
+		failed   []string // stages in the joined error
+		wraps    error
+	}{
+		{
+			name:     "all ok",
+			cfg:      RunnerConfig{Workers: 2},
+			stages:   []Stage{{Name: "a", Run: ok}, {Name: "b", Run: ok}, {Name: "c", Run: ok}},
+			outcomes: []string{"ok", "ok", "ok"},
+		},
+		{
+			name:     "a failure does not stop the others",
+			cfg:      RunnerConfig{Workers: 1},
+			stages:   []Stage{{Name: "a", Run: fail}, {Name: "b", Run: ok}, {Name: "c", Run: fail}},
+			outcomes: []string{"failed", "ok", "failed"},
+			failed:   []string{"a", "c"},
+			wraps:    errStage,
+		},
+		{
+			name:     "a panic fails its stage",
+			cfg:      RunnerConfig{Workers: 1},
+			stages:   []Stage{{Name: "a", Run: func(ctx context.Context) error { panic("boom") }}, {Name: "b", Run: ok}},
+			outcomes: []string{"failed", "ok"},
+			failed:   []string{"a"},
+		},
+		{
+			name:     "fail fast skips the stages not started",
+			cfg:      RunnerConfig{Workers: 1, FailFast: true},
+			stages:   []Stage{{Name: "a", Run: ok}, {Name: "b", Run: fail}, {Name: "c", Run: ok}},
+			outcomes: []string{"ok", "failed", "skipped"},
+			failed:   []string{"b"},
+			wraps:    errStage,
+		},
+		{
+			// a waits until b fails and cancels the run
+			name: "fail fast cancels the running stages",
+			cfg:  RunnerConfig{Workers: 2, FailFast: true},
+			stages: []Stage{
+				{Name: "a", Run: func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }},
+				{Name: "b", Run: fail},
+			},
+			outcomes: []string{"failed", "failed"},
+			failed:   []string{"a", "b"},
+			wraps:    context.Canceled,
+		},
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		done := make(map[string]string)
+		tt.cfg.OnDone = func(r StageResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			done[r.Name] = r.Outcome()
+		}
+		results, err := RunStages(context.Background(), tt.cfg, tt.stages)
+
+		var outcomes []string
+		for i, r := range results {
+			outcomes = append(outcomes, r.Outcome())
+			if r.Name != tt.stages[i].Name {
+				t.Errorf("%s: result %d is stage %s, want %s", tt.name, i, r.Name, tt.stages[i].Name)
+			}
+			if done[r.Name] != r.Outcome() {
+				t.Errorf("%s: OnDone saw %s %q, want %q", tt.name, r.Name, done[r.Name], r.Outcome())
+			}
+		}
+		if !reflect.DeepEqual(outcomes, tt.outcomes) {
+			t.Errorf("%s: outcomes %v, want %v", tt.name, outcomes, tt.outcomes)
+		}
+
+		var failed []string
+		if err != nil {
+			for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+				var stageErr *StageError
+				if !errors.As(e, &stageErr) {
+					t.Errorf("%s: error %v is not a *StageError", tt.name, e)
+					continue
+				}
+				failed = append(failed, stageErr.Stage)
+			}
+		}
+		if !reflect.DeepEqual(failed, tt.failed) {
+			t.Errorf("%s: failed stages %v (%v), want %v", tt.name, failed, err, tt.failed)
+		}
+		if tt.wraps != nil && !errors.Is(err, tt.wraps) {
+			t.Errorf("%s: error %v does not wrap %v", tt.name, err, tt.wraps)
+		}
+	}
+}
+
+func TestRunStagesCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ran := false
+	results, err := RunStages(ctx, RunnerConfig{Workers: 1}, []Stage{
+		{Name: "a", Run: func(ctx context.Context) error { ran = true; return nil }},
+	})
+	if ran || !results[0].Skipped || results[0].Outcome() != "skipped" {
+		t.Errorf("stage ran %v, result %+v, want it skipped", ran, results[0])
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error %v, want context.Canceled", err)
+	}
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		t.Errorf("error %v has a *StageError, skipped stages are not failures", err)
+	}
+}
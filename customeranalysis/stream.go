@@ -0,0 +1,136 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"TEST2024/database"
+)
+
+// StreamConfig selects how the customer sales are read.
+type StreamConfig struct {
+	// Enabled aggregates the purchases while they are scanned instead of
+	// loading them. Memory grows with the customers, not the events, but
+	// only the customer sales results are computed.
+	Enabled bool
+	// Pushdown lets MySQL sum the quantities by customer and content, so
+	// far fewer rows cross the network.
+	Pushdown bool
+}
+
+// SalesAggregator sums the sales of each customer one purchase at a time,
+// with the same rules as MakeCustomerSales.
+type SalesAggregator struct {
+	customerData  map[int]string
+	contentPrices map[int]Money
+	totals        map[int]Money
+	Rows          int // purchases added, priced or not
+}
+
+func NewSalesAggregator(customerData map[int]string, contentPrices map[int]Money) *SalesAggregator {
+	return &SalesAggregator{
+		customerData:  customerData,
+		contentPrices: contentPrices,
+		totals:        make(map[int]Money),
+	}
+}
+
+// Add counts quantity units of a content bought by a customer.
+func (a *SalesAggregator) Add(customerID, contentID, quantity int) {
+	a.Rows++
+	price, ok := a.contentPrices[contentID]
+	if !ok {
+		return // Skip if the content price is not found
+	}
+	a.totals[customerID] += price.Mul(quantity)
+}
+
+// Customers is the customers with a priced purchase, by decreasing TotalSales.
+func (a *SalesAggregator) Customers() []Customer {
+	customers := make([]Customer, 0, len(a.totals))
+	for customerID, total := range a.totals {
+		customers = append(customers, Customer{
+			CustomerID:  customerID,
+			Information: a.customerData[customerID],
+			TotalSales:  total,
+		})
+	}
+	sortCustomers(customers)
+	return customers
+}
+
+// sortCustomers orders by decreasing TotalSales, then by CustomerID so the
+// ranking does not change between runs.
+func sortCustomers(customers []Customer) {
+	sort.Slice(customers, func(i, j int) bool {
+		if customers[i].TotalSales != customers[j].TotalSales {
+			return customers[i].TotalSales > customers[j].TotalSales
+		}
+		return customers[i].CustomerID < customers[j].CustomerID
+	})
+}
+
+// StreamCustomerSales reads the same purchases as FetchCustomerEvents but
+// adds them to the totals as the rows arrive, never holding more than one
+// row. With pushdown the rows are already summed by customer and content.
+func StreamCustomerSales(ctx context.Context, db *sql.DB, customerData map[int]string, contentPrices map[int]Money, pushdown bool) ([]Customer, error) {
+	query := `
+	SELECT CustomerID, ContentID, Quantity
+	FROM CustomerEventData
+	WHERE EventDate >= ? AND EventTypeID = 6
+	`
+	if pushdown {
+		query = `
+		SELECT CustomerID, ContentID, SUM(Quantity)
+		FROM CustomerEventData
+		WHERE EventDate >= ? AND EventTypeID = 6
+		GROUP BY CustomerID, ContentID
+		`
+	}
+	ctx, cancel := database.WithQueryTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query, PurchasesSince)
+	if err != nil {
+		return nil, database.Classify("reading CustomerEventData", err)
+	}
+	defer rows.Close()
+
+	aggregator := NewSalesAggregator(customerData, contentPrices)
+	for rows.Next() {
+		var customerID, contentID, quantity int
+		if err := rows.Scan(&customerID, &contentID, &quantity); err != nil {
+			return nil, database.Classify("reading CustomerEventData", err)
+		}
+		aggregator.Add(customerID, contentID, quantity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, database.Classify("reading CustomerEventData", err)
+	}
+	countRead("CustomerEventData", aggregator.Rows)
+	return aggregator.Customers(), nil
+}
+
+// streamCustomers is fetchCustomers for StreamConfig.Enabled: the events
+// and every table only the event analyses need are not read.
+func streamCustomers(ctx context.Context, db *sql.DB, opts Options) (SalesData, error) {
+	customerData, err := FetchCustomerData(ctx, db)
+	if err != nil {
+		return SalesData{}, database.Classify("fetching customer data", err)
+	}
+	contentPrices, err := FetchContentPrices(ctx, db)
+	if err != nil {
+		return SalesData{}, database.Classify("fetching content prices", err)
+	}
+	countRead("CustomerData", len(customerData))
+	countRead("ContentPrice", len(contentPrices))
+	customers, err := StreamCustomerSales(ctx, db, customerData, contentPrices, opts.Stream.Pushdown)
+	if err != nil {
+		return SalesData{}, database.Classify("streaming customer sales", err)
+	}
+	return SalesData{
+		CustomerData:  customerData,
+		ContentPrices: contentPrices,
+		Customers:     customers,
+	}, nil
+}
@@ -0,0 +1,146 @@
+package customeranalysis
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// benchPurchases is a fixed set of generated purchases: customers and
+// contents with prices, one content in 50 without a price like in the
+// generated data.
+type benchPurchases struct {
+	customerData  map[int]string
+	contentPrices map[int]Money
+	events        []CustomerEvent
+}
+
+func newBenchPurchases(events, customers, contents int) benchPurchases {
+	b := benchPurchases{
+		customerData:  make(map[int]string, customers),
+		contentPrices: make(map[int]Money, contents),
+		events:        make([]CustomerEvent, events),
+	}
+	for id := 1; id <= customers; id++ {
+		b.customerData[id] = "customer " + strconv.Itoa(id)
+	}
+	for id := 1; id <= contents; id++ {
+		b.contentPrices[id] = Money(id%97+1) * 2500 // 0.25 to 24.25
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := range b.events {
+		b.events[i] = CustomerEvent{
+			CustomerID: 1 + r.Intn(customers),
+			ContentID:  1 + r.Intn(contents+contents/50),
+			Quantity:   1 + r.Intn(5),
+		}
+	}
+	return b
+}
+
+func (b benchPurchases) loaded() []Customer {
+	customers := MakeCustomerSales(b.events, b.customerData, b.contentPrices)
+	sortCustomers(customers)
+	return customers
+}
+
+func (b benchPurchases) streamed() []Customer {
+	aggregator := NewSalesAggregator(b.customerData, b.contentPrices)
+	for _, e := range b.events {
+		aggregator.Add(e.CustomerID, e.ContentID, e.Quantity)
+	}
+	return aggregator.Customers()
+}
+
+func TestSalesAggregatorMatchesMakeCustomerSales(t *testing.T) {
+	b := newBenchPurchases(20000, 2000, 100)
+	want, got := b.loaded(), b.streamed()
+	if len(got) != len(want) {
+		t.Fatalf("streamed %d customers, loaded %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("customer %d: streamed %+v, loaded %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// fetched copies the events one at a time, as FetchCustomerEvents appends
+// the scanned rows, so the benchmark holds them like the loaded path does.
+func (b benchPurchases) fetched() []Customer {
+	var events []CustomerEvent
+	for _, e := range b.events {
+		events = append(events, e)
+	}
+	customers := MakeCustomerSales(events, b.customerData, b.contentPrices)
+	sortCustomers(customers)
+	return customers
+}
+
+// grouped is the rows of the -pushdown query: the quantities summed by
+// customer and content, as MySQL returns them.
+func (b benchPurchases) grouped() []CustomerEvent {
+	type key struct{ customerID, contentID int }
+	quantities := make(map[key]int)
+	for _, e := range b.events {
+		quantities[key{e.CustomerID, e.ContentID}] += e.Quantity
+	}
+	rows := make([]CustomerEvent, 0, len(quantities))
+	for k, quantity := range quantities {
+		rows = append(rows, CustomerEvent{CustomerID: k.customerID, ContentID: k.contentID, Quantity: quantity})
+	}
+	return rows
+}
+
+func TestPushdownMatchesMakeCustomerSales(t *testing.T) {
+	b := newBenchPurchases(20000, 2000, 100)
+	want := b.loaded()
+	aggregator := NewSalesAggregator(b.customerData, b.contentPrices)
+	for _, e := range b.grouped() {
+		aggregator.Add(e.CustomerID, e.ContentID, e.Quantity)
+	}
+	got := aggregator.Customers()
+	if len(got) != len(want) {
+		t.Fatalf("pushed down %d customers, loaded %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("customer %d: pushed down %+v, loaded %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// Compare the B/op of the three paths with go test -bench . -benchmem.
+func BenchmarkMakeCustomerSales(b *testing.B) {
+	purchases := newBenchPurchases(1000000, 50000, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		purchases.fetched()
+	}
+}
+
+func BenchmarkSalesAggregator(b *testing.B) {
+	purchases := newBenchPurchases(1000000, 50000, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		purchases.streamed()
+	}
+}
+
+// BenchmarkSalesAggregatorPushdown adds the rows of the -pushdown query,
+// the summing itself is done by MySQL.
+func BenchmarkSalesAggregatorPushdown(b *testing.B) {
+	purchases := newBenchPurchases(1000000, 50000, 1000)
+	rows := purchases.grouped()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		aggregator := NewSalesAggregator(purchases.customerData, purchases.contentPrices)
+		for _, e := range rows {
+			aggregator.Add(e.CustomerID, e.ContentID, e.Quantity)
+		}
+		aggregator.Customers()
+	}
+}
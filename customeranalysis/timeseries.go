@@ -0,0 +1,212 @@
+package customeranalysis
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"time"
+
+	"TEST2024/database"
+)
+
+// Granularity is the length of a time series period.
+type Granularity string
+
+const (
+	Daily   Granularity = "day"
+	Weekly  Granularity = "week" // weeks start on Monday
+	Monthly Granularity = "month"
+)
+
+// SeriesSplit tells how the time series is broken down.
+type SeriesSplit string
+
+const (
+	SplitNone    SeriesSplit = "none"
+	SplitContent SeriesSplit = "content"
+	SplitChannel SeriesSplit = "channel" // ChannelTypeID of the customer
+)
+
+// TimeSeriesConfig configures the sales time series.
+type TimeSeriesConfig struct {
+	Granularity   Granularity
+	Split         SeriesSplit
+	MovingAverage int // periods in the revenue moving average
+}
+
+// SalesPeriod is the sales of one segment in one period.
+type SalesPeriod struct {
+	Period          time.Time // first day of the period
+	Segment         string    // "all", a ContentID or a ChannelTypeID
+	Revenue         Money
+	Units           int
+	Orders          int // purchase events
+	ActiveCustomers int
+	RevenueMA       Money // over the last MovingAverage periods, this one included
+	// RevenueGrowth is the change from the previous period of the segment,
+	// 0 when the previous period made no revenue.
+	RevenueGrowth float64
+}
+
+func FetchCustomerChannelTypes(ctx context.Context, db *sql.DB) (map[int]int, error) {
+	query := `SELECT CustomerID, ChannelTypeID FROM CustomerData`
+	ctx, cancel := database.WithQueryTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, database.Classify("reading CustomerData", err)
+	}
+	defer rows.Close()
+
+	channelTypes := make(map[int]int)
+	for rows.Next() {
+		var customerID, channelType int
+		if err := rows.Scan(&customerID, &channelType); err != nil {
+			return nil, database.Classify("reading CustomerData", err)
+		}
+		channelTypes[customerID] = channelType
+	}
+	if err := rows.Err(); err != nil {
+		return nil, database.Classify("reading CustomerData", err)
+	}
+	return channelTypes, nil
+}
+
+// periodStart truncates t to the start of its period.
+func periodStart(t time.Time, g Granularity) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch g {
+	case Weekly:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case Monthly:
+		return day.AddDate(0, 0, 1-day.Day())
+	}
+	return day
+}
+
+func nextPeriod(t time.Time, g Granularity) time.Time {
+	switch g {
+	case Weekly:
+		return t.AddDate(0, 0, 7)
+	case Monthly:
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// computeTimeSeries buckets the purchases by period and segment. Every
+// segment gets a row for every period between the first and the last
+// purchase, so the moving averages and growth rates see the empty periods.
+func computeTimeSeries(events []CustomerEvent, contentPrices map[int]Money, channelTypes map[int]int, cfg TimeSeriesConfig) []SalesPeriod {
+	type key struct {
+		period  time.Time
+		segment string
+	}
+	type activity struct {
+		key
+		customerID int
+	}
+	periods := make(map[key]*SalesPeriod)
+	active := make(map[activity]bool)
+	segments := make(map[string]bool)
+	var first, last time.Time
+	pricedEvents(events, contentPrices, func(e CustomerEvent, revenue Money) {
+		segment := "all"
+		switch cfg.Split {
+		case SplitContent:
+			segment = strconv.Itoa(e.ContentID)
+		case SplitChannel:
+			segment = strconv.Itoa(channelTypes[e.CustomerID])
+		}
+		k := key{periodStart(e.EventDate, cfg.Granularity), segment}
+		p, exists := periods[k]
+		if !exists {
+			p = &SalesPeriod{Period: k.period, Segment: segment}
+			periods[k] = p
+		}
+		p.Revenue += revenue
+		p.Units += e.Quantity
+		p.Orders++
+		if a := (activity{k, e.CustomerID}); !active[a] {
+			active[a] = true
+			p.ActiveCustomers++
+		}
+		segments[segment] = true
+		if first.IsZero() || k.period.Before(first) {
+			first = k.period
+		}
+		if k.period.After(last) {
+			last = k.period
+		}
+	})
+
+	names := make([]string, 0, len(segments))
+	for segment := range segments {
+		names = append(names, segment)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, errA := strconv.Atoi(names[i])
+		b, errB := strconv.Atoi(names[j])
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return names[i] < names[j]
+	})
+
+	window := max(1, cfg.MovingAverage)
+	var series []SalesPeriod
+	for _, segment := range names {
+		var revenues []Money
+		for t := first; !t.After(last); t = nextPeriod(t, cfg.Granularity) {
+			p := SalesPeriod{Period: t, Segment: segment}
+			if found, ok := periods[key{t, segment}]; ok {
+				p = *found
+			}
+			revenues = append(revenues, p.Revenue)
+
+			n := len(revenues)
+			recent := revenues[max(0, n-window):]
+			var sum Money
+			for _, r := range recent {
+				sum += r
+			}
+			p.RevenueMA = sum.Div(len(recent))
+			if n > 1 {
+				p.RevenueGrowth = (p.Revenue - revenues[n-2]).Ratio(revenues[n-2])
+			}
+			series = append(series, p)
+		}
+	}
+	return series
+}
+
+// insertTimeSeries replaces the rows of the SalesTimeSeries table for this
+// granularity and split, so the other series stay available to dashboards.
+func insertTimeSeries(ctx context.Context, db *sql.DB, cfg TimeSeriesConfig, series []SalesPeriod) error {
+	rows := make([][]interface{}, len(series))
+	for i, p := range series {
+		rows[i] = []interface{}{string(cfg.Granularity), string(cfg.Split), p.Segment, p.Period.Format("2006-01-02"), p.Revenue, p.Units, p.Orders, p.ActiveCustomers, p.RevenueMA, p.RevenueGrowth}
+	}
+	return replaceTables(ctx, db, tableRows{
+		ddl: `
+	CREATE TABLE IF NOT EXISTS SalesTimeSeries (
+		Granularity CHAR(5),
+		SplitBy CHAR(8),
+		Segment CHAR(32),
+		Period DATE,
+		Revenue DECIMAL(18,4),
+		Units INT,
+		Orders INT,
+		ActiveCustomers INT,
+		RevenueMovingAvg DECIMAL(18,4),
+		RevenueGrowth DOUBLE,
+		PRIMARY KEY (Granularity, SplitBy, Segment, Period)
+	);`,
+		table:     "SalesTimeSeries",
+		columns:   []string{"Granularity", "SplitBy", "Segment", "Period", "Revenue", "Units", "Orders", "ActiveCustomers", "RevenueMovingAvg", "RevenueGrowth"},
+		rows:      rows,
+		where:     "Granularity = ? AND SplitBy = ?",
+		whereArgs: []interface{}{string(cfg.Granularity), string(cfg.Split)},
+	})
+}
@@ -0,0 +1,81 @@
+package customeranalysis
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPeriodStart(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		t     time.Time
+		g     Granularity
+		want  time.Time
+		after time.Time // nextPeriod(want)
+	}{
+		{date(2023, 3, 15).Add(13 * time.Hour), Daily, date(2023, 3, 15), date(2023, 3, 16)},
+		{date(2023, 3, 15).Add(13 * time.Hour), Weekly, date(2023, 3, 13), date(2023, 3, 20)}, // Wednesday
+		{date(2023, 3, 19), Weekly, date(2023, 3, 13), date(2023, 3, 20)},                     // Sunday
+		{date(2023, 3, 13), Weekly, date(2023, 3, 13), date(2023, 3, 20)},                     // Monday
+		{date(2023, 1, 1), Weekly, date(2022, 12, 26), date(2023, 1, 2)},
+		{date(2023, 3, 31).Add(23 * time.Hour), Monthly, date(2023, 3, 1), date(2023, 4, 1)},
+		{date(2023, 12, 5), Monthly, date(2023, 12, 1), date(2024, 1, 1)},
+	}
+	for _, tt := range tests {
+		got := periodStart(tt.t, tt.g)
+		if !got.Equal(tt.want) {
+			t.Errorf("periodStart(%v, %s) = %v, want %v", tt.t, tt.g, got, tt.want)
+		}
+		if next := nextPeriod(got, tt.g); !next.Equal(tt.after) {
+			t.Errorf("nextPeriod(%v, %s) = %v, want %v", got, tt.g, next, tt.after)
+		}
+	}
+}
+
+func TestComputeTimeSeries(t *testing.T) {
+	day := func(d, hour int) time.Time { return time.Date(2023, 3, d, hour, 0, 0, 0, time.UTC) }
+	prices := map[int]Money{10: 100000, 2: 10000}
+	channelTypes := map[int]int{1: 1, 2: 2}
+	events := []CustomerEvent{
+		{CustomerID: 1, ContentID: 10, Quantity: 1, EventDate: day(1, 9)},
+		{CustomerID: 2, ContentID: 2, Quantity: 5, EventDate: day(1, 18)},
+		{CustomerID: 1, ContentID: 10, Quantity: 3, EventDate: day(3, 10)},
+		{CustomerID: 1, ContentID: 10, Quantity: 1, EventDate: day(3, 11)},
+		{CustomerID: 2, ContentID: 9, Quantity: 1, EventDate: day(5, 12)}, // no price, not a period
+	}
+
+	// 15 on the 1st, nothing on the 2nd, 40 on the 3rd; a growth from 0 is 0
+	got := computeTimeSeries(events, prices, channelTypes, TimeSeriesConfig{Granularity: Daily, Split: SplitNone, MovingAverage: 2})
+	want := []SalesPeriod{
+		{Period: day(1, 0), Segment: "all", Revenue: 150000, Units: 6, Orders: 2, ActiveCustomers: 2, RevenueMA: 150000},
+		{Period: day(2, 0), Segment: "all", RevenueMA: 75000, RevenueGrowth: -1},
+		{Period: day(3, 0), Segment: "all", Revenue: 400000, Units: 4, Orders: 2, ActiveCustomers: 1, RevenueMA: 200000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("daily series =\n%+v\nwant\n%+v", got, want)
+	}
+
+	got = computeTimeSeries(events, prices, channelTypes, TimeSeriesConfig{Granularity: Daily, Split: SplitChannel, MovingAverage: 2})
+	want = []SalesPeriod{
+		{Period: day(1, 0), Segment: "1", Revenue: 100000, Units: 1, Orders: 1, ActiveCustomers: 1, RevenueMA: 100000},
+		{Period: day(2, 0), Segment: "1", RevenueMA: 50000, RevenueGrowth: -1},
+		{Period: day(3, 0), Segment: "1", Revenue: 400000, Units: 4, Orders: 2, ActiveCustomers: 1, RevenueMA: 200000},
+		{Period: day(1, 0), Segment: "2", Revenue: 50000, Units: 5, Orders: 1, ActiveCustomers: 1, RevenueMA: 50000},
+		{Period: day(2, 0), Segment: "2", RevenueMA: 25000, RevenueGrowth: -1},
+		{Period: day(3, 0), Segment: "2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("series by channel =\n%+v\nwant\n%+v", got, want)
+	}
+
+	// content segments sort as numbers, 2 before 10
+	got = computeTimeSeries(events, prices, channelTypes, TimeSeriesConfig{Granularity: Monthly, Split: SplitContent, MovingAverage: 1})
+	var segments []string
+	for _, p := range got {
+		segments = append(segments, p.Segment)
+	}
+	if want := []string{"2", "10"}; !reflect.DeepEqual(segments, want) {
+		t.Errorf("monthly content segments = %v, want %v", segments, want)
+	}
+}
@@ -1,19 +1,27 @@
 package customeranalysis
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
-	"sort"
+	"log/slog"
 	"time"
 
+	"TEST2024/database"
+	"TEST2024/metrics"
+
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// PurchasesSince is the first EventDate counted in the sales.
+const PurchasesSince = "2020-04-01 00:00:00"
+
 type CustomerEvent struct {
-	CustomerID int
-	ContentID  int
-	Quantity   int
+	EventDataID int
+	CustomerID  int
+	ContentID   int
+	Quantity    int
+	EventDate   time.Time
 }
 
 type CustomerData struct {
@@ -23,44 +31,58 @@ type CustomerData struct {
 
 type ContentPrice struct {
 	ContentID int
-	Price     float64
+	Price     Money
 }
 
 type Customer struct {
 	CustomerID  int
 	Information string
-	TotalSales  float64
+	TotalSales  Money
 }
 
 type QuantileInfo struct {
 	NumberOfCustomers int
-	MaxSales          float64
+	MaxSales          Money
+}
+
+// Quantile is one row of the Quantilesdata and Quantiles_BY_CA tables.
+type Quantile struct {
+	QuantileRange     string
+	NumberOfCustomers int
+	MaxSales          Money
 }
 
-func FetchContentPrices(db *sql.DB) (map[int]float64, error) {
+func FetchContentPrices(ctx context.Context, db *sql.DB) (map[int]Money, error) {
 	query := `SELECT ContentID, Price FROM ContentPrice`
-	rows, err := db.Query(query)
+	ctx, cancel := database.WithQueryTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, database.Classify("reading ContentPrice", err)
 	}
 	defer rows.Close()
 
-	contentPrices := make(map[int]float64)
+	contentPrices := make(map[int]Money)
 	for rows.Next() {
 		var contentID int
-		var price float64
+		var price Money
 		if err := rows.Scan(&contentID, &price); err != nil {
-			return nil, err
+			return nil, database.Classify("reading ContentPrice", err)
 		}
 		contentPrices[contentID] = price
 	}
+	if err := rows.Err(); err != nil {
+		return nil, database.Classify("reading ContentPrice", err)
+	}
 	return contentPrices, nil
 }
-func FetchCustomerData(db *sql.DB) (map[int]string, error) {
+func FetchCustomerData(ctx context.Context, db *sql.DB) (map[int]string, error) {
 	query := `SELECT CustomerID, ChannelValue FROM CustomerData`
-	rows, err := db.Query(query)
+	ctx, cancel := database.WithQueryTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, database.Classify("reading CustomerData", err)
 	}
 	defer rows.Close()
 
@@ -69,43 +91,81 @@ func FetchCustomerData(db *sql.DB) (map[int]string, error) {
 		var customerID int
 		var channelValue string
 		if err := rows.Scan(&customerID, &channelValue); err != nil {
-			return nil, err
+			return nil, database.Classify("reading CustomerData", err)
 		}
 		customerData[customerID] = channelValue
 	}
+	if err := rows.Err(); err != nil {
+		return nil, database.Classify("reading CustomerData", err)
+	}
 	return customerData, nil
 }
-func FetchCustomerEvents(db *sql.DB) ([]CustomerEvent, error) {
+func FetchCustomerSignups(ctx context.Context, db *sql.DB) (map[int]time.Time, error) {
+	query := `SELECT CustomerID, InsertDate FROM Customer`
+	ctx, cancel := database.WithQueryTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, database.Classify("reading Customer", err)
+	}
+	defer rows.Close()
+
+	signups := make(map[int]time.Time)
+	for rows.Next() {
+		var customerID int
+		var insertDate time.Time
+		if err := rows.Scan(&customerID, &insertDate); err != nil {
+			return nil, database.Classify("reading Customer", err)
+		}
+		signups[customerID] = insertDate
+	}
+	if err := rows.Err(); err != nil {
+		return nil, database.Classify("reading Customer", err)
+	}
+	return signups, nil
+}
+func FetchCustomerEvents(ctx context.Context, db *sql.DB) ([]CustomerEvent, error) {
 	query := `
-	SELECT CustomerID, ContentID, Quantity
+	SELECT EventDataID, CustomerID, ContentID, Quantity, EventDate
 	FROM CustomerEventData
-	WHERE EventDate >= '2020-04-01 00:00:00' AND EventTypeID = 6
+	WHERE EventDate >= ? AND EventTypeID = 6
 	`
-	rows, err := db.Query(query)
+	ctx, cancel := database.WithQueryTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query, PurchasesSince)
 	if err != nil {
-		return nil, err
+		return nil, database.Classify("reading CustomerEventData", err)
 	}
 	defer rows.Close()
 
 	var events []CustomerEvent
 	for rows.Next() {
 		var e CustomerEvent
-		if err := rows.Scan(&e.CustomerID, &e.ContentID, &e.Quantity); err != nil {
-			return nil, err
+		if err := rows.Scan(&e.EventDataID, &e.CustomerID, &e.ContentID, &e.Quantity, &e.EventDate); err != nil {
+			return nil, database.Classify("reading CustomerEventData", err)
 		}
 		events = append(events, e)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, database.Classify("reading CustomerEventData", err)
+	}
 	return events, nil
 }
-func MakeCustomerSales(events []CustomerEvent, customerData map[int]string, contentPrices map[int]float64) []Customer {
-	customerSales := make(map[int]*Customer)
-	for _, event := range events {
-		price, ok := contentPrices[event.ContentID]
-		if !ok {
-			continue // Skip if the content price is not found
+
+// pricedEvents calls f with every purchase of a priced content and its
+// value, price x quantity. Purchases of a content without a price are left
+// out of every result.
+func pricedEvents(events []CustomerEvent, contentPrices map[int]Money, f func(e CustomerEvent, value Money)) {
+	for _, e := range events {
+		if price, ok := contentPrices[e.ContentID]; ok {
+			f(e, price.Mul(e.Quantity))
 		}
-		totalSale := price * float64(event.Quantity)
+	}
+}
 
+func MakeCustomerSales(events []CustomerEvent, customerData map[int]string, contentPrices map[int]Money) []Customer {
+	customerSales := make(map[int]*Customer)
+	pricedEvents(events, contentPrices, func(event CustomerEvent, totalSale Money) {
 		if cust, exists := customerSales[event.CustomerID]; exists {
 			cust.TotalSales += totalSale
 		} else {
@@ -115,7 +175,7 @@ func MakeCustomerSales(events []CustomerEvent, customerData map[int]string, cont
 				TotalSales:  totalSale,
 			}
 		}
-	}
+	})
 
 	var customers []Customer
 	for _, cust := range customerSales {
@@ -124,32 +184,88 @@ func MakeCustomerSales(events []CustomerEvent, customerData map[int]string, cont
 	return customers
 }
 
+// SalesData is what the analysis reads from the database.
+type SalesData struct {
+	Events        []CustomerEvent // purchases since PurchasesSince
+	CustomerData  map[int]string
+	ContentPrices map[int]Money
+	Signups       map[int]time.Time // Customer.InsertDate of every customer
+	FunnelEvents  []FunnelEvent     // events of the Options.Funnel steps
+	Contents      map[int]string    // ClientContentID by ContentID
+	ChannelTypes  map[int]int       // ChannelTypeID by CustomerID
+	TopHistory    []TopSnapshot     // daily top customers tables before today
+	Customers     []Customer        // by decreasing TotalSales
+}
+
 // fetchCustomers retrieves customer data from the database.
-func fetchCustomers(db *sql.DB) ([]Customer, error) {
+func fetchCustomers(ctx context.Context, db *sql.DB, opts Options) (SalesData, error) {
+	if opts.Stream.Enabled {
+		return streamCustomers(ctx, db, opts)
+	}
 	// Fetch data
-	events, err := FetchCustomerEvents(db)
+	events, err := FetchCustomerEvents(ctx, db)
+	if err != nil {
+		return SalesData{}, database.Classify("fetching customer events", err)
+	}
+	customerData, err := FetchCustomerData(ctx, db)
+	if err != nil {
+		return SalesData{}, database.Classify("fetching customer data", err)
+	}
+	contentPrices, err := FetchContentPrices(ctx, db)
+	if err != nil {
+		return SalesData{}, database.Classify("fetching content prices", err)
+	}
+	signups, err := FetchCustomerSignups(ctx, db)
+	if err != nil {
+		return SalesData{}, database.Classify("fetching customer signups", err)
+	}
+	funnelEvents, err := FetchFunnelEvents(ctx, db, opts.Funnel.Steps)
+	if err != nil {
+		return SalesData{}, database.Classify("fetching funnel events", err)
+	}
+	contents, err := FetchContents(ctx, db)
 	if err != nil {
-		log.Fatal("Error fetching customer events: ", err)
+		return SalesData{}, database.Classify("fetching contents", err)
 	}
-	customerData, err := FetchCustomerData(db)
+	channelTypes, err := FetchCustomerChannelTypes(ctx, db)
 	if err != nil {
-		log.Fatal("Error fetching customer data: ", err)
+		return SalesData{}, database.Classify("fetching channel types", err)
 	}
-	contentPrices, err := FetchContentPrices(db)
+	topHistory, err := FetchTopHistory(ctx, db)
 	if err != nil {
-		log.Fatal("Error fetching content prices: ", err)
+		return SalesData{}, database.Classify("fetching top customers history", err)
 	}
+	countRead("CustomerEventData", len(events)+len(funnelEvents))
+	countRead("CustomerData", len(customerData)+len(channelTypes))
+	countRead("ContentPrice", len(contentPrices))
+	countRead("Customer", len(signups))
+	countRead("Content", len(contents))
+
 	// Aggregate customer sales
 	customers := MakeCustomerSales(events, customerData, contentPrices)
-	sort.Slice(customers, func(i, j int) bool {
-		return customers[i].TotalSales > customers[j].TotalSales
-	})
+	sortCustomers(customers)
+
+	return SalesData{
+		Events:        events,
+		CustomerData:  customerData,
+		ContentPrices: contentPrices,
+		Signups:       signups,
+		FunnelEvents:  funnelEvents,
+		Contents:      contents,
+		ChannelTypes:  channelTypes,
+		TopHistory:    topHistory,
+		Customers:     customers,
+	}, nil
+}
 
-	return customers, nil
+// countRead logs and counts the rows read from a source table.
+func countRead(table string, rows int) {
+	metrics.Rows.Add(float64(rows), table, "read")
+	slog.Info("table read", "table", table, "rows", rows)
 }
 
 // createAndPopulateCustomerTable creates a new customer table and populates it with data.
-func createAndPopulateCustomerTable(db *sql.DB, customers []Customer) error {
+func createAndPopulateCustomerTable(ctx context.Context, db *sql.DB, customers []Customer) error {
 	today := time.Now().Format("20060102") // Get current date for naming the table.
 	tableName := fmt.Sprintf("test_2024_%s", today)
 
@@ -158,7 +274,7 @@ func createAndPopulateCustomerTable(db *sql.DB, customers []Customer) error {
 		ID INT AUTO_INCREMENT PRIMARY KEY,
 		CustomerID INT,
 		INFO CHAR(255),
-		TotalSales FLOAT
+		TotalSales DECIMAL(18,4)
 	);
 	`, tableName) // SQL statement to create a new table.
 
@@ -168,9 +284,9 @@ func createAndPopulateCustomerTable(db *sql.DB, customers []Customer) error {
 	// Keep track of the top customers already inserted into the table.
 	topCustomers := make(map[int]bool)
 
-	_, err := db.Exec(createTable)
+	_, err := database.Exec(ctx, db, createTable)
 	if err != nil {
-		return fmt.Errorf("error creating table: %v", err)
+		return fmt.Errorf("error creating table: %w", err)
 	}
 
 	// Prepare SQL statements for checking existence, updating, inserting and deleting the no longer top customers.
@@ -179,204 +295,234 @@ func createAndPopulateCustomerTable(db *sql.DB, customers []Customer) error {
 	insertQuery := fmt.Sprintf(`INSERT INTO %s (CustomerID, INFO, TotalSales) VALUES (?, ?, ?)`, tableName)
 	deleteQuery := fmt.Sprintf(`DELETE FROM %s WHERE CustomerID = ?`, tableName)
 
-	for i, c := range customers {
+	err = database.InTx(ctx, db, func(tx *sql.Tx) error {
+		for i, c := range customers {
 
-		if i <= topPercent {
-			topCustomers[c.CustomerID] = true // Mark this customer as part of the top.
-		}
+			if i <= topPercent {
+				topCustomers[c.CustomerID] = true // Mark this customer as part of the top.
+			}
 
-		var exists bool
-		err = db.QueryRow(existingQuery, c.CustomerID).Scan(&exists) // Check if the customer already exists in the table.
-		if err != nil {
-			return err
-		}
+			var exists bool
+			err = existsIn(ctx, tx, existingQuery, c.CustomerID, &exists) // Check if the customer already exists in the table.
+			if err != nil {
+				return err
+			}
+
+			if exists {
+				if topCustomers[c.CustomerID] {
+					_, err = database.Exec(ctx, tx, updateQuery, c.TotalSales, c.CustomerID) // Update existing customer.
+				} else {
+					_, err = database.Exec(ctx, tx, deleteQuery, c.CustomerID) // deleting customers that exist and no longer in the to customers .
+				}
 
-		if exists {
-			if topCustomers[c.CustomerID] {
-				_, err = db.Exec(updateQuery, c.TotalSales, c.CustomerID) // Update existing customer.
 			} else {
-				_, err = db.Exec(deleteQuery, c.CustomerID) // deleting customers that exist and no longer in the to customers .
-			}
+				if topCustomers[c.CustomerID] {
+					_, err = database.Exec(ctx, tx, insertQuery, c.CustomerID, c.Information, c.TotalSales) // Insert new customer.
+				}
 
-		} else {
-			if topCustomers[c.CustomerID] {
-				_, err = db.Exec(insertQuery, c.CustomerID, c.Information, c.TotalSales) // Insert new customer.
 			}
 
+			if err != nil {
+				return err
+			}
 		}
-
-		if err != nil {
-			return err
-		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s AUTO_INCREMENT = 1;`, tableName))
+	_, err = database.Exec(ctx, db, fmt.Sprintf(`ALTER TABLE %s AUTO_INCREMENT = 1;`, tableName))
 	if err != nil {
-		fmt.Println("Error occurred:", err)
+		return fmt.Errorf("error resetting %s AUTO_INCREMENT: %w", tableName, err)
 	}
 	return nil
 }
 
-// createAndPopulateQuantilesTable creates a new table for quantile data and populates it.
-func createAndPopulateQuantilesTable(db *sql.DB, customers []Customer) error {
-	quantileSize := int(0.025 * float64(len(customers))) // Calculate the size of each quantile.
-	Map := make(map[string]QuantileInfo)                 // Create a map to store quantile information.
+// existsIn scans the boolean result of query into exists.
+func existsIn(ctx context.Context, tx *sql.Tx, query string, customerID int, exists *bool) error {
+	ctx, cancel := database.WithQueryTimeout(ctx)
+	defer cancel()
+	err := tx.QueryRowContext(ctx, query, customerID).Scan(exists)
+	if database.PlanFrom(ctx) != nil && database.IsMissingTable(err) {
+		*exists = false // a dry run does not create the table
+		return nil
+	}
+	return database.Classify("checking the top customers table", err)
+}
+
+// rankQuantileSize is the number of customers in each 2.5% rank quantile.
+func rankQuantileSize(customers int) int {
+	quantileSize := int(0.025 * float64(customers)) // Calculate the size of each quantile.
+	if quantileSize == 0 {
+		quantileSize = 1 // less than 40 customers, one per quantile
+	}
+	return quantileSize
+}
+
+// rankQuantileIndex places the i-th best customer in one of the 40 quantiles.
+func rankQuantileIndex(i, quantileSize int) int {
+	index := i / quantileSize
+	if index >= 40 {
+		index = 39 // Force the last entries into the 40th quantile
+	}
+	return index
+}
+
+func rankQuantileRange(index int) string {
+	return fmt.Sprintf("%f%% - %f%%", 2.5*float64(index), 2.5*float64(index+1))
+}
+
+// rankQuantiles splits the sorted customers into 40 buckets of 2.5% each.
+func rankQuantiles(customers []Customer) []Quantile {
+	quantileSize := rankQuantileSize(len(customers))
+	infos := make([]QuantileInfo, 40)
+	used := 0
 
 	for i, c := range customers {
-		index := i / quantileSize
-		if index >= 40 {
-			index = 39 // Force the last entries into the 40th quantile
-		}
-		quantile := fmt.Sprintf("%f%% - %f%%", 2.5*float64(index), 2.5*float64(index+1))
-		info := Map[quantile]
+		index := rankQuantileIndex(i, quantileSize)
+		info := &infos[index]
 		info.NumberOfCustomers++
 		if c.TotalSales > info.MaxSales {
 			info.MaxSales = c.TotalSales
 		}
-		Map[quantile] = info // Update the map with the new quantile information.
+		used = index + 1
+	}
+
+	quantiles := make([]Quantile, 0, used)
+	for index, info := range infos[:used] {
+		quantiles = append(quantiles, Quantile{
+			QuantileRange:     rankQuantileRange(index),
+			NumberOfCustomers: info.NumberOfCustomers,
+			MaxSales:          info.MaxSales,
+		})
 	}
+	return quantiles
+}
 
-	createTableSQL := `
-	CREATE TABLE Quantilesdata (
+// createAndPopulateQuantilesTable creates a new table for quantile data and populates it.
+func createAndPopulateQuantilesTable(ctx context.Context, db *sql.DB, quantiles []Quantile) error {
+	return replaceTable(ctx, db, `
+	CREATE TABLE IF NOT EXISTS Quantilesdata (
 		ID INT AUTO_INCREMENT PRIMARY KEY,
 		QuantileRange CHAR(50),
 		NumberOfCustomers INT,
-		MaxSales FLOAT
-	);` // SQL statement to create a table for quantile data.
-
-	_, err := db.Exec(createTableSQL)
-	if err != nil {
-		return fmt.Errorf("Error creating table: %v", err)
-	}
+		MaxSales DECIMAL(18,4)
+	);`, "Quantilesdata", quantileColumns, quantileRows(quantiles)) // the quantiles are recomputed on every run
+}
 
-	CustomerByQuantile, err := db.Prepare("INSERT INTO Quantilesdata (QuantileRange, NumberOfCustomers, MaxSales) VALUES (?, ?, ?)")
-	if err != nil {
-		panic(err)
-	}
-	defer CustomerByQuantile.Close()
+// quantileColumns are the columns of Quantilesdata and Quantiles_BY_CA.
+var quantileColumns = []string{"QuantileRange", "NumberOfCustomers", "MaxSales"}
 
-	for quantileRange, info := range Map {
-		_, err = CustomerByQuantile.Exec(quantileRange, info.NumberOfCustomers, info.MaxSales) // Insert quantile data into the table.
-		if err != nil {
-			fmt.Println("Error occurred:", err)
-		}
+func quantileRows(quantiles []Quantile) [][]interface{} {
+	rows := make([][]interface{}, len(quantiles))
+	for i, q := range quantiles {
+		rows[i] = []interface{}{q.QuantileRange, q.NumberOfCustomers, q.MaxSales}
 	}
-
-	return nil
+	return rows
 }
 
-func calculateAndInsertAboveAverageCustomers(db *sql.DB, customers []Customer) error {
-	var totalSales float64
+// aboveAverageCustomers returns the customers whose sales are above the average.
+func aboveAverageCustomers(customers []Customer) ([]Customer, Money) {
+	if len(customers) == 0 {
+		return nil, 0
+	}
+	var totalSales Money
 	for _, c := range customers {
 		totalSales += c.TotalSales
 	}
-	averageSales := totalSales / float64(len(customers))
+	averageSales := totalSales.Div(len(customers))
 
-	// Create table for above average customers
-	_, err := db.Exec(`
-	CREATE TABLE IF NOT EXISTS AboveAverageCustomers (
-		ID INT AUTO_INCREMENT PRIMARY KEY,
-		CustomerID INT,
-		TotalSales FLOAT
-	);
-	`)
-	if err != nil {
-		return fmt.Errorf("error creating AboveAverageCustomers table: %v", err)
-	}
-
-	// Insert customers with sales above average into the table.
+	var above []Customer
 	for _, c := range customers {
 		if c.TotalSales > averageSales {
-			_, err := db.Exec("INSERT INTO AboveAverageCustomers (CustomerID, TotalSales) VALUES (?, ?)", c.CustomerID, c.TotalSales)
-			if err != nil {
-				return fmt.Errorf("error inserting above average customer: %v", err)
-			}
+			above = append(above, c)
 		}
 	}
+	return above, averageSales
+}
 
-	return nil
+func insertAboveAverageCustomers(ctx context.Context, db *sql.DB, above []Customer) error {
+	rows := make([][]interface{}, len(above))
+	for i, c := range above {
+		rows[i] = []interface{}{c.CustomerID, c.TotalSales}
+	}
+	return replaceTable(ctx, db, `
+	CREATE TABLE IF NOT EXISTS AboveAverageCustomers (
+		ID INT AUTO_INCREMENT PRIMARY KEY,
+		CustomerID INT,
+		TotalSales DECIMAL(18,4)
+	);`, "AboveAverageCustomers", []string{"CustomerID", "TotalSales"}, rows) // the average changes from run to run
 }
 
-func quantileBYCA(db *sql.DB, customers []Customer) error {
+// salesQuantiles divides the sales range (CA) into 40 equal-width buckets.
+// The bounds are exact amounts, rounded down, and the smallest sales fall in
+// the first bucket.
+func salesQuantiles(customers []Customer) []Quantile {
+	if len(customers) == 0 {
+		return nil
+	}
 
 	maxCA := customers[0].TotalSales
 	minCA := customers[len(customers)-1].TotalSales
-	rangePerQuantile := (maxCA - minCA) / 40 // devide the CA range into 40 categories
+	bound := func(i int) Money { return minCA + (maxCA-minCA)*Money(i)/40 } // devide the CA range into 40 categories
 
-	// Create a map to store quantile information.
-	quantileMap := make(map[string]QuantileInfo)
+	quantiles := make([]Quantile, 0, 40)
 
-	// Populate the quantile map.
+	// Populate the quantiles.
 	for i := 0; i < 40; i++ {
-		startRange := minCA + (rangePerQuantile * float64(i))
-		endRange := minCA + (rangePerQuantile * float64(i+1))
-		quantile := fmt.Sprintf("%.2f - %.2f", startRange, endRange) // CA range
-		info := quantileMap[quantile]
+		startRange := bound(i)
+		endRange := bound(i + 1)
+		quantile := Quantile{QuantileRange: fmt.Sprintf("%s - %s", startRange.Round2(), endRange.Round2())} // CA range
 		for _, c := range customers {
 
 			// see customer's total sales is in the range of the quantile
-			if c.TotalSales > startRange && c.TotalSales <= endRange {
+			if (c.TotalSales > startRange || i == 0 && c.TotalSales == minCA) && c.TotalSales <= endRange {
 				// If it does, increment the number of customers in this quantile.
-				info.NumberOfCustomers++
+				quantile.NumberOfCustomers++
 
 				// Update the maximum sales if applicable.
-				if c.TotalSales > info.MaxSales {
-					info.MaxSales = c.TotalSales
+				if c.TotalSales > quantile.MaxSales {
+					quantile.MaxSales = c.TotalSales
 				}
 			}
 
 		}
-		quantileMap[quantile] = info // Update the map with the new quantile information.
+		quantiles = append(quantiles, quantile)
 
 	}
-	createTableSQL := `
-	CREATE TABLE Quantiles_BY_CA (
+	return quantiles
+}
+
+func quantileBYCA(ctx context.Context, db *sql.DB, quantiles []Quantile) error {
+	return replaceTable(ctx, db, `
+	CREATE TABLE IF NOT EXISTS Quantiles_BY_CA (
 		ID INT AUTO_INCREMENT PRIMARY KEY,
 		QuantileRange CHAR(50),
 		NumberOfCustomers INT,
-		MaxSales FLOAT
-	);`
-
-	_, err := db.Exec(createTableSQL)
-	if err != nil {
-		return fmt.Errorf("Error creating table: %v", err)
-	}
-
-	insertQuery := `INSERT INTO Quantiles_BY_CA (QuantileRange, NumberOfCustomers, MaxSales) VALUES (?, ?, ?)`
-
-	for quantileRange, info := range quantileMap {
-
-		_, err := db.Exec(insertQuery, quantileRange, info.NumberOfCustomers, info.MaxSales)
-		if err != nil {
-			fmt.Println("Error occurred:", err)
-		}
-	}
-
-	return nil
+		MaxSales DECIMAL(18,4)
+	);`, "Quantiles_BY_CA", quantileColumns, quantileRows(quantiles)) // the quantiles are recomputed on every run
 }
 
 // //////////////////////////////////////////////////////// main funtion
-func RunCustomerAnalysis(db *sql.DB) {
+// Under database.WithPlan the analysis runs but its writes are only recorded
+// in the plan.
+func RunCustomerAnalysis(ctx context.Context, db *sql.DB) error {
+	return RunCustomerAnalysisTo(ctx, db, DefaultOptions(), DBSink{DB: db})
+}
 
-	customers, err := fetchCustomers(db) //fetching all the customers
-	if err != nil {
-		log.Fatal(err)
-	}
+// RunCustomerAnalysisTo computes the analysis once and writes it to every sink.
+func RunCustomerAnalysisTo(ctx context.Context, db *sql.DB, opts Options, sinks ...Sink) error {
 
-	err = createAndPopulateCustomerTable(db, customers) // creating the top customers table
+	data, err := fetchCustomers(ctx, db, opts) //fetching all the customers
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	err = createAndPopulateQuantilesTable(db, customers) // quantile table
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = quantileBYCA(db, customers) // seconde quantile table
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = calculateAndInsertAboveAverageCustomers(db, customers) // all customer above Average
-	if err != nil {
-		log.Fatal(err)
+	results := ComputeResults(data, opts)
+	for _, sink := range sinks {
+		if err := sink.Write(ctx, results); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -1,27 +1,144 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
 	"sync"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"TEST2024/apperr"
+	"TEST2024/metrics"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 var (
 	dbInstance *sql.DB
+	openErr    error
 	once       sync.Once
 )
 
-// getDBInstance returns a singleton instance of the database connection.
-func GetDBInstance() *sql.DB {
+// GetDBInstance returns a singleton instance of the database connection,
+// after checking that MySQL answers.
+func GetDBInstance(ctx context.Context) (*sql.DB, error) {
 	once.Do(func() {
 		// Open a new database connection.
-		dsn := "root:brahim@tcp(localhost:3306)/test"
-		db, err := sql.Open("mysql", dsn)
-		if err != nil {
-			panic(err)
-		}
-		dbInstance = db
+		dsn := "root:brahim@tcp(localhost:3306)/test?parseTime=true"
+		dbInstance, openErr = sql.Open("mysql", dsn)
 	})
-	return dbInstance
+	if openErr != nil {
+		return nil, apperr.Wrap(apperr.Config, "opening the database", openErr)
+	}
+	ctx, cancel := withTimeout(ctx, "ping")
+	defer cancel()
+	if err := dbInstance.PingContext(ctx); err != nil {
+		return nil, apperr.Wrap(apperr.Connection, "connecting to MySQL", err)
+	}
+	return dbInstance, nil
+}
+
+// Classify adds op to a driver error, as a Connection failure when MySQL
+// cannot be reached or refuses the login, as a Query failure otherwise.
+// Errors that already have a Kind keep it.
+func Classify(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	kind := apperr.Query
+	var netErr net.Error
+	var mysqlErr *mysql.MySQLError
+	switch {
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn), errors.As(err, &netErr):
+		kind = apperr.Connection
+	case errors.As(err, &mysqlErr) && (mysqlErr.Number == 1044 || mysqlErr.Number == 1045):
+		kind = apperr.Connection // access denied
+	}
+	return apperr.Wrap(kind, op, err)
+}
+
+// QueryTimeout bounds every statement run through Exec or WithQueryTimeout,
+// so a hung query fails instead of blocking forever. 0 disables it.
+var QueryTimeout time.Duration
+
+// WithQueryTimeout derives the context of one query from ctx. The rows must
+// be read before cancel is called; cancel also records the duration of the
+// query in metrics.QueryDuration.
+func WithQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, "select")
+}
+
+func withTimeout(ctx context.Context, statement string) (context.Context, context.CancelFunc) {
+	start := time.Now()
+	var cancel context.CancelFunc
+	if QueryTimeout <= 0 {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithTimeout(ctx, QueryTimeout)
+	}
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			elapsed := time.Since(start)
+			metrics.QueryDuration.Observe(elapsed.Seconds(), statement)
+			slog.Debug("statement done", "statement", statement, "duration", elapsed)
+		})
+		cancel()
+	}
+}
+
+// ScanRow runs a single row query within QueryTimeout and scans it into
+// dest. It returns sql.ErrNoRows when the query selects nothing.
+func ScanRow(ctx context.Context, db *sql.DB, query string, args []interface{}, dest ...interface{}) error {
+	ctx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	return db.QueryRowContext(ctx, query, args...).Scan(dest...)
+}
+
+// statementVerb is the lowercase first word of query, like insert.
+func statementVerb(query string) string {
+	if fields := strings.Fields(query); len(fields) > 0 {
+		return strings.ToLower(fields[0])
+	}
+	return "unknown"
+}
+
+// Execer runs write statements. It is satisfied by *sql.DB and *sql.Tx, so
+// writers can run inside a transaction or not.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Exec runs one statement within QueryTimeout and records its duration.
+// In a dry run (see WithPlan) the statement is added to the plan instead.
+func Exec(ctx context.Context, db Execer, query string, args ...interface{}) (sql.Result, error) {
+	if plan := PlanFrom(ctx); plan != nil {
+		return plan.record(ctx, db, query, args)
+	}
+	ctx, cancel := withTimeout(ctx, statementVerb(query))
+	defer cancel()
+	result, err := db.ExecContext(ctx, query, args...)
+	return result, Classify("", err)
+}
+
+// InTx runs write in a transaction tied to ctx. It commits when write
+// succeeds and rolls back when write fails or ctx is cancelled, for example
+// on SIGINT, so an interrupted run leaves no partial writes behind. MySQL
+// commits on DDL, so CREATE and ALTER statements belong before InTx.
+// In a dry run the transaction is read only and always rolled back.
+func InTx(ctx context.Context, db *sql.DB, write func(tx *sql.Tx) error) error {
+	plan := PlanFrom(ctx)
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: plan != nil})
+	if err != nil {
+		return Classify("starting a transaction", err)
+	}
+	if err := write(tx); err != nil || plan != nil {
+		tx.Rollback()
+		return err
+	}
+	return Classify("committing", tx.Commit())
 }
@@ -0,0 +1,323 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Plan records the writes of a dry run instead of running them: Exec adds
+// the DDL and the rows each statement would insert, update or delete, and
+// InTx rolls back. The reads still run, so the plan is computed from the
+// data as it is.
+type Plan struct {
+	Samples int // affected rows kept per table and operation
+
+	mu     sync.Mutex
+	ddl    []plannedDDL
+	tables map[string]*TableChanges
+}
+
+// TableChanges is what a plan would change in one table.
+type TableChanges struct {
+	Table                     string
+	Inserts, Updates, Deletes int
+	Sample                    []PlannedRow
+}
+
+// PlannedRow is an affected row: the values inserted, or the current
+// values of a row updated or deleted.
+type PlannedRow struct {
+	Op      string // insert, update or delete
+	Columns []string
+	Values  []interface{}
+}
+
+type plannedDDL struct {
+	table, statement string
+}
+
+func NewPlan() *Plan {
+	return &Plan{Samples: 3, tables: make(map[string]*TableChanges)}
+}
+
+type planKey struct{}
+
+// WithPlan returns a ctx whose writes are recorded in plan, not run.
+func WithPlan(ctx context.Context, plan *Plan) context.Context {
+	return context.WithValue(ctx, planKey{}, plan)
+}
+
+// PlanFrom is the plan of a dry run, nil when ctx writes for real.
+func PlanFrom(ctx context.Context) *Plan {
+	plan, _ := ctx.Value(planKey{}).(*Plan)
+	return plan
+}
+
+// IsMissingTable tells if err is MySQL reporting an unknown table, which a
+// dry run reads when the table would only be created by its DDL.
+func IsMissingTable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1146
+}
+
+// queryer reads the rows a statement would affect. It is satisfied by
+// *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+var (
+	insertPattern = regexp.MustCompile(`(?is)^INSERT\s+INTO\s+(\S+)\s*\(([^)]*)\)`)
+	updatePattern = regexp.MustCompile(`(?is)^UPDATE\s+(\S+)\s+SET\s+(.*?)\s+WHERE\s+(.*)$`)
+	deletePattern = regexp.MustCompile(`(?is)^DELETE\s+FROM\s+(\S+)(?:\s+WHERE\s+(.*))?$`)
+	ddlPattern    = regexp.MustCompile(`(?is)^(?:CREATE|ALTER|DROP|TRUNCATE)\s+TABLE\s+(?:IF\s+(?:NOT\s+)?EXISTS\s+)?(\S+)`)
+)
+
+// record adds query to the plan. Updates and deletes are counted, and
+// sampled, by selecting the rows their WHERE matches through db.
+func (p *Plan) record(ctx context.Context, db Execer, query string, args []interface{}) (sql.Result, error) {
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	switch verb := statementVerb(query); verb {
+	case "create", "alter", "drop", "truncate":
+		var table string
+		if m := ddlPattern.FindStringSubmatch(query); m != nil {
+			table = m[1]
+		}
+		p.mu.Lock()
+		p.ddl = append(p.ddl, plannedDDL{table, dedent(query)})
+		p.mu.Unlock()
+		return plannedResult(0), nil
+
+	case "insert":
+		m := insertPattern.FindStringSubmatch(query)
+		if m == nil {
+			return nil, fmt.Errorf("dry run cannot read the insert %q", query)
+		}
+		columns := strings.Split(m[2], ",")
+		for i := range columns {
+			columns[i] = strings.TrimSpace(columns[i])
+		}
+		rows := len(args) / len(columns)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		changes := p.table(m[1])
+		changes.Inserts += rows
+		for i := 0; i < rows; i++ {
+			p.sample(changes, PlannedRow{"insert", columns, args[i*len(columns) : (i+1)*len(columns)]})
+		}
+		return plannedResult(rows), nil
+
+	case "update", "delete":
+		var table, where string
+		var whereArgs []interface{}
+		if m := updatePattern.FindStringSubmatch(query); verb == "update" && m != nil {
+			table, where = m[1], m[3]
+			whereArgs = args[strings.Count(m[2], "?"):]
+		} else if m := deletePattern.FindStringSubmatch(query); verb == "delete" && m != nil {
+			table, where, whereArgs = m[1], m[2], args
+		} else {
+			return nil, fmt.Errorf("dry run cannot read the statement %q", query)
+		}
+		rows, err := p.affected(ctx, db, verb, table, where, whereArgs)
+		if err != nil {
+			return nil, err
+		}
+		return plannedResult(rows), nil
+	}
+	return nil, fmt.Errorf("dry run cannot plan the statement %q", query)
+}
+
+// affected counts and samples the rows of table matching where.
+func (p *Plan) affected(ctx context.Context, db Execer, op, table, where string, args []interface{}) (int, error) {
+	reader, ok := db.(queryer)
+	if !ok {
+		return 0, fmt.Errorf("dry run cannot read %s", table)
+	}
+	if where != "" {
+		where = " WHERE " + where
+	}
+	ctx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	rows, err := reader.QueryContext(ctx, "SELECT * FROM "+table+where, args...)
+	if IsMissingTable(err) {
+		return 0, nil // created by the planned DDL, so empty
+	}
+	if err != nil {
+		return 0, Classify("reading the rows to "+op, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, Classify("reading the rows to "+op, err)
+	}
+
+	var sample []PlannedRow
+	count := 0
+	for rows.Next() {
+		count++
+		if len(sample) >= p.Samples {
+			continue
+		}
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return 0, Classify("reading the rows to "+op, err)
+		}
+		sample = append(sample, PlannedRow{op, columns, values})
+	}
+	if err := rows.Err(); err != nil {
+		return 0, Classify("reading the rows to "+op, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changes := p.table(table)
+	if op == "update" {
+		changes.Updates += count
+	} else {
+		changes.Deletes += count
+	}
+	for _, row := range sample {
+		p.sample(changes, row)
+	}
+	return count, nil
+}
+
+// table is the changes of name, the caller holds mu.
+func (p *Plan) table(name string) *TableChanges {
+	changes, ok := p.tables[name]
+	if !ok {
+		changes = &TableChanges{Table: name}
+		p.tables[name] = changes
+	}
+	return changes
+}
+
+// sample keeps row unless the table has enough rows of that operation.
+func (p *Plan) sample(changes *TableChanges, row PlannedRow) {
+	kept := 0
+	for _, r := range changes.Sample {
+		if r.Op == row.Op {
+			kept++
+		}
+	}
+	if kept < p.Samples {
+		changes.Sample = append(changes.Sample, row)
+	}
+}
+
+// DDL is the planned DDL statements, by table, in the order they were run.
+func (p *Plan) DDL() []string {
+	p.mu.Lock()
+	ddl := append([]plannedDDL(nil), p.ddl...)
+	p.mu.Unlock()
+	sort.SliceStable(ddl, func(i, j int) bool { return ddl[i].table < ddl[j].table })
+	statements := make([]string, len(ddl))
+	for i, d := range ddl {
+		statements[i] = d.statement
+	}
+	return statements
+}
+
+// Tables is the changes of every table written, by name.
+func (p *Plan) Tables() []TableChanges {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tables := make([]TableChanges, 0, len(p.tables))
+	for _, changes := range p.tables {
+		tables = append(tables, *changes)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Table < tables[j].Table })
+	return tables
+}
+
+// Report writes the DDL, the counts per table and the sampled rows.
+func (p *Plan) Report(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "dry run: nothing was written")
+	fmt.Fprintln(tw, "\nplanned DDL:")
+	for _, statement := range p.DDL() {
+		fmt.Fprintf(tw, "  %s;\n", strings.ReplaceAll(statement, "\n", "\n  "))
+	}
+	tables := p.Tables()
+	fmt.Fprintln(tw, "\ntable\tinserts\tupdates\tdeletes\t")
+	for _, t := range tables {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t\n", t.Table, t.Inserts, t.Updates, t.Deletes)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if len(t.Sample) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\nsample of %s:\n", t.Table)
+		for _, row := range t.Sample {
+			fields := make([]string, len(row.Columns))
+			for i, column := range row.Columns {
+				fields[i] = column + "=" + formatValue(row.Values[i])
+			}
+			if _, err := fmt.Fprintf(w, "  %-6s  %s\n", row.Op, strings.Join(fields, ", ")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05")
+	case string:
+		return fmt.Sprintf("%q", v)
+	}
+	return fmt.Sprint(v)
+}
+
+// dedent trims a statement written in Go source, keeping the indentation
+// of its lines relative to each other.
+func dedent(statement string) string {
+	lines := strings.Split(statement, "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		n := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	for i := 1; i < len(lines); i++ {
+		if len(lines[i]) >= indent && indent > 0 {
+			lines[i] = lines[i][indent:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// plannedResult is the result of a statement recorded by a plan: the rows
+// it would affect.
+type plannedResult int
+
+func (r plannedResult) LastInsertId() (int64, error) { return 0, nil }
+func (r plannedResult) RowsAffected() (int64, error) { return int64(r), nil }
@@ -1,12 +1,18 @@
 package datageneration
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"log/slog"
 	"math/rand"
 	"strings"
 	"time"
 
+	"TEST2024/apperr"
+	"TEST2024/customeranalysis"
+	"TEST2024/database"
+	"TEST2024/metrics"
+
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/icrowley/fake"
 )
@@ -35,7 +41,7 @@ type Content struct {
 type ContentPrice struct {
 	ContentPriceID int
 	ContentID      int
-	Price          float64
+	Price          customeranalysis.Money `parquet:"Price,decimal(4:18)"`
 	Currency       string
 	InsertDate     time.Time
 }
@@ -80,34 +86,23 @@ func weightedRandomChoice(r *rand.Rand, weights []float64) int {
 	return 6
 }
 
-func fakePriceAndCurrency(r *rand.Rand) (float64, string) {
+func fakePriceAndCurrency(r *rand.Rand) (customeranalysis.Money, string) {
 
-	price := r.Float64() * 1000 // Generate a price between 0 and 1000
+	price := customeranalysis.MoneyFromFloat(r.Float64() * 1000) // Generate a price between 0 and 1000
 
 	currency := "USD"
 
 	return price, currency
 }
 
-func randomTimestamp(r *rand.Rand, year int) time.Time {
-
-	month := time.Month(r.Intn(12) + 1)
-	day := r.Intn(28) + 1 // keeping it simple, not accounting for month length
-	hour := r.Intn(24)
-	minute := r.Intn(60)
-	second := r.Intn(60)
-
-	// Create a new timestamp with these components
-	return time.Date(year, month, day, hour, minute, second, 0, time.UTC)
-}
-
-func generateCustomers(r *rand.Rand) ([]Customer, []CustomerData) {
-	// generating 1000 fake customer
+func generateCustomers(r *rand.Rand, cfg Config, existing existingData) ([]Customer, []CustomerData) {
+	// generating cfg.Customers fake customer, after the ones already there
 	var customers []Customer
 	var customerData []CustomerData
-	for i := 1; i < 1000; i++ {
+	for n := 1; n <= cfg.Customers; n++ {
+		i := existing.max.CustomerID + n
 		// Use the fake package or similar to generate realistic data
-		date := randomTimestamp(r, 2023)
+		date := randomTimestamp(r, cfg.Range)
 		channelType := r.Intn(5) + 1
 		var chv string
 		switch channelType {
@@ -129,7 +124,7 @@ func generateCustomers(r *rand.Rand) ([]Customer, []CustomerData) {
 			InsertDate:       date,
 		})
 		customerData = append(customerData, CustomerData{
-			CustomerChannelID: i,
+			CustomerChannelID: existing.max.CustomerChannelID + n,
 			CustomerID:        i,
 			ChannelTypeID:     channelType,
 			ChannelValue:      chv,
@@ -138,15 +133,16 @@ func generateCustomers(r *rand.Rand) ([]Customer, []CustomerData) {
 	}
 	return customers, customerData
 }
-func generateContents(r *rand.Rand) ([]Content, []ContentPrice) {
-	// generating 1000 fake customer
+func generateContents(r *rand.Rand, cfg Config, existing existingData) ([]Content, []ContentPrice) {
+	// generating cfg.Contents fake content, after the ones already there
 	var contents []Content
 	var contentPrices []ContentPrice
-	for j := 1; j <= 100; j++ {
-		randomTime := randomTimestamp(r, 2023)
+	for n := 1; n <= cfg.Contents; n++ {
+		j := existing.max.ContentID + n
+		randomTime := randomTimestamp(r, cfg.Range)
 		price, currency := fakePriceAndCurrency(r)
 		contentPrices = append(contentPrices, ContentPrice{
-			ContentPriceID: j,
+			ContentPriceID: existing.max.ContentPriceID + n,
 			ContentID:      j,
 			Price:          price,
 			Currency:       currency,
@@ -163,60 +159,230 @@ func generateContents(r *rand.Rand) ([]Content, []ContentPrice) {
 
 }
 
-func generateEvents(r *rand.Rand, db *sql.DB) ([]CustomerEvent, []CustomerEventData) {
+func generateEvents(r *rand.Rand, cfg Config, existing existingData, customers []Customer, contents []Content) ([]CustomerEvent, []CustomerEventData) {
 
 	var events []CustomerEvent
 	var eventdata []CustomerEventData
-	for i := 1; i <= 5000; i++ {
-
-		var customerID int
-		var contentID int
-		// random CustomerID
-		err := db.QueryRow("SELECT CustomerID FROM Customer ORDER BY RAND() LIMIT 1").Scan(&customerID)
-		if err != nil {
-			fmt.Println("Error occurred:", err)
-		}
-
-		// random ContentID
-		err = db.QueryRow("SELECT ContentID FROM Content ORDER BY RAND() LIMIT 1").Scan(&contentID)
-		if err != nil {
-			fmt.Println("Error occurred:", err)
-		}
-		eventTypeWeights := []float64{0.1, 0.2, 0.19, 0.18, 0.165, 0.165} // this is my choice
-		eventTypeIndex := weightedRandomChoice(r, eventTypeWeights)       // trying to get reel event type
-		randomTime := randomTimestamp(r, 2023)
-
+	if len(customers) == 0 || len(contents) == 0 {
+		return events, eventdata
+	}
+	behavior := cfg.Behavior
+	// the population weights use their own seed, so the same customers and
+	// contents stay popular from one append run to the next
+	population := rand.New(rand.NewSource(cfg.PopulationSeed))
+	customerPicker := newWeightedPicker(behavior.Customers.Weights(population, len(customers)))
+	contentPicker := newWeightedPicker(behavior.Contents.Weights(population, len(contents)))
+
+	addEvent := func(customerID, contentID, eventType int, eventTime time.Time) {
+		n := len(events) + 1
+		insertDate := insertDateAfter(r, eventTime, cfg.MaxInsertDelay)
 		events = append(events, CustomerEvent{
-			EventID:       i,
+			EventID:       existing.max.EventID + n,
 			ClientEventID: fake.DigitsN(10),
-			InsertDate:    randomTime,
+			InsertDate:    insertDate,
 		})
 		eventdata = append(eventdata, CustomerEventData{
-			EventDataID: i,
-			EventID:     i,
+			EventDataID: existing.max.EventDataID + n,
+			EventID:     existing.max.EventID + n,
 			ContentID:   contentID,
 			CustomerID:  customerID,
-			EventTypeID: eventTypeIndex,
-			EventDate:   randomTime,
+			EventTypeID: eventType,
+			EventDate:   eventTime,
 			Quantity:    r.Intn(6) + 1,
-			InsertDate:  randomTime,
+			InsertDate:  insertDate,
 		})
+	}
+
+	for len(events) < cfg.Events {
+		customerID := customers[customerPicker.pick(r)].CustomerID
+		contentID := contents[contentPicker.pick(r)].ContentID
+		randomTime := seasonalTimestamp(r, cfg.Range, behavior.Seasonality)
 
+		if behavior.Funnel == nil {
+			eventTypeIndex := weightedRandomChoice(r, behavior.EventTypeWeights) // trying to get reel event type
+			addEvent(customerID, contentID, eventTypeIndex, randomTime)
+			continue
+		}
+
+		// walk the funnel: the same customer views, then maybe carts, then maybe buys
+		funnel := behavior.Funnel
+		for step, eventType := range funnel.Steps {
+			if step > 0 {
+				if len(events) == cfg.Events {
+					break // the last session is cut short, not the count exceeded
+				}
+				if r.Float64() >= funnel.Continue[step-1] {
+					break
+				}
+				randomTime = randomTime.Add(time.Duration(r.Int63n(int64(funnel.MaxStepGap))) + time.Second)
+				if !randomTime.Before(cfg.Range.End) {
+					break // keep the whole session inside the range
+				}
+			}
+			addEvent(customerID, contentID, eventType, randomTime)
+		}
 	}
 	return events, eventdata
 }
 
 //////////////////////////////////////////////////////////////
 
+// Config controls the size and the behavior of the generated data.
+type Config struct {
+	Customers int // number of new customers
+	Contents  int // number of new contents
+	Events    int // number of CustomerEventData rows to generate
+	// Range bounds every generated date. Event dates are weighted by
+	// Behavior.Seasonality, use NoSeasonality for a uniform distribution.
+	Range TimeRange
+	// MaxInsertDelay is the longest time between an event and its insertion,
+	// InsertDate is never before EventDate.
+	MaxInsertDelay time.Duration
+	Behavior       BehaviorModel
+	// PopulationSeed draws which customers and contents are popular.
+	PopulationSeed int64
+	// Append continues from the IDs already in the tables, and events also
+	// use the existing customers and contents.
+	Append bool
+	// NextDay replaces Range with the day after the latest EventDate, to
+	// simulate one more day of activity. It needs Append. Without events
+	// yet, Range is kept and a warning logged.
+	NextDay bool
+}
+
+// DefaultConfig returns 5000 events in 2023 (UTC) with RealisticBehavior.
+func DefaultConfig() Config {
+	return Config{
+		Customers:      999,
+		Contents:       100,
+		Events:         5000,
+		Range:          YearRange(2023, time.UTC),
+		MaxInsertDelay: 15 * time.Minute,
+		Behavior:       RealisticBehavior(),
+		PopulationSeed: 2024,
+	}
+}
+
+// Validate rejects a config the generator cannot draw events from: a funnel
+// without a Continue chance or a gap for each step, or a range where the
+// seasonality never allows activity.
+func (cfg Config) Validate() error {
+	if f := cfg.Behavior.Funnel; f != nil {
+		if err := f.validate(); err != nil {
+			return err
+		}
+	} else if len(cfg.Behavior.EventTypeWeights) == 0 {
+		return apperr.Errorf(apperr.Config, "the behavior has neither a funnel nor event type weights")
+	}
+	if cfg.Events <= 0 {
+		return nil // no date is drawn
+	}
+	if !cfg.Range.Start.Before(cfg.Range.End) {
+		return apperr.Errorf(apperr.Config, "the range %s to %s is empty", cfg.Range.Start, cfg.Range.End)
+	}
+	if cfg.Behavior.Seasonality == nil {
+		return apperr.Errorf(apperr.Config, "the behavior has no seasonality, use NoSeasonality for none")
+	}
+	if !hasActivity(cfg.Range, cfg.Behavior.Seasonality) {
+		return apperr.Errorf(apperr.Config, "the seasonality weight is 0 over the whole range %s to %s", cfg.Range.Start, cfg.Range.End)
+	}
+	return nil
+}
+
 //main function
 
-func GenerateData(db *sql.DB) {
+// GenerateData fills the source tables with DefaultConfig. Under
+// database.WithPlan the rows are generated but only recorded in the plan.
+func GenerateData(ctx context.Context, db *sql.DB) error {
+	return GenerateDataWithConfig(ctx, db, DefaultConfig())
+}
+
+// GenerateDataWithConfig fills the source tables using cfg, in one
+// transaction.
+func GenerateDataWithConfig(ctx context.Context, db *sql.DB, cfg Config) error {
+	ds, err := GenerateDataset(ctx, db, cfg)
+	if err != nil {
+		return err
+	}
+	err = database.InTx(ctx, db, func(tx *sql.Tx) error {
+		return InsertDataset(ctx, tx, ds)
+	})
+	if err != nil {
+		return err
+	}
+	if database.PlanFrom(ctx) == nil { // a dry run wrote nothing
+		countWritten(ds)
+	}
+	return nil
+}
+
+// Dataset holds the rows of the six source tables.
+type Dataset struct {
+	Customers         []Customer
+	CustomerData      []CustomerData
+	Contents          []Content
+	ContentPrices     []ContentPrice
+	CustomerEvents    []CustomerEvent
+	CustomerEventData []CustomerEventData
+}
+
+// countWritten logs and counts the rows of ds once they are written.
+func countWritten(ds Dataset) {
+	for _, t := range []struct {
+		table string
+		rows  int
+	}{
+		{"Customer", len(ds.Customers)},
+		{"CustomerData", len(ds.CustomerData)},
+		{"Content", len(ds.Contents)},
+		{"ContentPrice", len(ds.ContentPrices)},
+		{"CustomerEvent", len(ds.CustomerEvents)},
+		{"CustomerEventData", len(ds.CustomerEventData)},
+	} {
+		metrics.Rows.Add(float64(t.rows), t.table, "write")
+		slog.Info("table written", "table", t.table, "rows", t.rows)
+	}
+}
+
+// GenerateDataset builds the rows without writing them. db is only read in
+// append mode and can be nil otherwise.
+func GenerateDataset(ctx context.Context, db *sql.DB, cfg Config) (Dataset, error) {
 
 	src := rand.NewSource(time.Now().UnixNano())
 	r := rand.New(src)
 
-	customers, customersData := generateCustomers(r)
-	contents, contentprices := generateContents(r)
+	var existing existingData
+	if cfg.Append {
+		var err error
+		existing, err = loadExistingData(ctx, db)
+		if err != nil {
+			return Dataset{}, err
+		}
+		if cfg.NextDay {
+			if existing.lastEventDate.IsZero() {
+				slog.Warn("no events yet, -next-day keeps the default range", "from", cfg.Range.Start, "to", cfg.Range.End)
+			} else {
+				cfg.Range = nextDayRange(existing.lastEventDate, cfg.Range.location())
+			}
+		}
+	}
+	// checked once the range is final, the seasonality depends on it
+	if err := cfg.Validate(); err != nil {
+		return Dataset{}, err
+	}
+
+	var ds Dataset
+	ds.Customers, ds.CustomerData = generateCustomers(r, cfg, existing)
+	ds.Contents, ds.ContentPrices = generateContents(r, cfg, existing)
+	ds.CustomerEvents, ds.CustomerEventData = generateEvents(r, cfg, existing, append(existing.customers, ds.Customers...), append(existing.contents, ds.Contents...))
+	return ds, nil
+}
+
+// InsertDataset writes every row of ds into the source tables.
+func InsertDataset(ctx context.Context, db database.Execer, ds Dataset) error {
+	customers, customersData := ds.Customers, ds.CustomerData
+	contents, contentprices := ds.Contents, ds.ContentPrices
+	events, eventsdata := ds.CustomerEvents, ds.CustomerEventData
 	//CUSTOMER
 	customerInsertQuery := "INSERT INTO Customer (CustomerID, ClientCustomerID, InsertDate) VALUES "
 	customerDataInsertQuery := "INSERT INTO CustomerData (CustomerChannelID, CustomerID, ChannelTypeID, ChannelValue, InsertDate) VALUES "
@@ -229,20 +395,16 @@ func GenerateData(db *sql.DB) {
 		valueStrings = append(valueStrings, "(?, ?, ?)")
 		valueArgs = append(valueArgs, customer.CustomerID, customer.ClientCustomerID, customer.InsertDate)
 	}
-	customerInsertQuery += strings.Join(valueStrings, ",")
-	_, err := db.Exec(customerInsertQuery, valueArgs...)
-	if err != nil {
-		panic(err)
+	if err := bulkInsert(ctx, db, customerInsertQuery, valueStrings, valueArgs); err != nil {
+		return err
 	}
 
 	for _, customerdata := range customersData {
 		data_valueStrings = append(data_valueStrings, "(?, ?, ?, ?, ?)")
 		datavalueArgs = append(datavalueArgs, customerdata.CustomerChannelID, customerdata.CustomerID, customerdata.ChannelTypeID, customerdata.ChannelValue, customerdata.InsertDate)
 	}
-	customerDataInsertQuery += strings.Join(data_valueStrings, ",")
-	_, err2 := db.Exec(customerDataInsertQuery, datavalueArgs...)
-	if err2 != nil {
-		panic(err2)
+	if err := bulkInsert(ctx, db, customerDataInsertQuery, data_valueStrings, datavalueArgs); err != nil {
+		return err
 	}
 	//Content
 	contentInsertQuery := "INSERT INTO Content (ContentID, ClientContentID, InsertDate) VALUES "
@@ -256,23 +418,18 @@ func GenerateData(db *sql.DB) {
 		c_valueStrings = append(c_valueStrings, "(?, ?, ?)")
 		c_valueArgs = append(c_valueArgs, c.ContentID, c.ClientContentID, c.InsertDate)
 	}
-	contentInsertQuery += strings.Join(c_valueStrings, ",")
-	_, err3 := db.Exec(contentInsertQuery, c_valueArgs...)
-	if err3 != nil {
-		panic(err3)
+	if err := bulkInsert(ctx, db, contentInsertQuery, c_valueStrings, c_valueArgs); err != nil {
+		return err
 	}
 
 	for _, cp := range contentprices {
 		cp_valueStrings = append(cp_valueStrings, "(?, ?, ?, ?, ?)")
 		cp_valueArgs = append(cp_valueArgs, cp.ContentPriceID, cp.ContentID, cp.Price, cp.Currency, cp.InsertDate)
 	}
-	contentPriceInsertQuery += strings.Join(cp_valueStrings, ",")
-	_, err4 := db.Exec(contentPriceInsertQuery, cp_valueArgs...)
-	if err4 != nil {
-		panic(err4)
+	if err := bulkInsert(ctx, db, contentPriceInsertQuery, cp_valueStrings, cp_valueArgs); err != nil {
+		return err
 	}
 	//EVENT
-	events, eventsdata := generateEvents(r, db)
 	EventInsertQuery := "INSERT INTO CustomerEvent (EventID, ClientEventID, InsertDate) VALUES "
 	EventDataInsertQuery := "INSERT INTO CustomerEventData (EventDataID, EventID, ContentID, CustomerID, EventTypeID, EventDate, Quantity, InsertDate) VALUES "
 	e_valueStrings := make([]string, 0, len(events))
@@ -284,22 +441,26 @@ func GenerateData(db *sql.DB) {
 		e_valueStrings = append(e_valueStrings, "(?, ?, ?)")
 		e_valueArgs = append(e_valueArgs, e.EventID, e.ClientEventID, e.InsertDate)
 	}
-	EventInsertQuery += strings.Join(e_valueStrings, ",")
-
-	_, err5 := db.Exec(EventInsertQuery, e_valueArgs...)
-	if err5 != nil {
-		panic(err5)
+	if err := bulkInsert(ctx, db, EventInsertQuery, e_valueStrings, e_valueArgs); err != nil {
+		return err
 	}
 
 	for _, ed := range eventsdata {
 		ed_valueStrings = append(ed_valueStrings, "(?, ?, ?, ?, ?, ?, ?, ?)")
 		ed_valueArgs = append(ed_valueArgs, ed.EventDataID, ed.EventID, ed.ContentID, ed.CustomerID, ed.EventTypeID, ed.EventDate, ed.Quantity, ed.InsertDate)
 	}
-	EventDataInsertQuery += strings.Join(ed_valueStrings, ",")
-
-	_, err6 := db.Exec(EventDataInsertQuery, ed_valueArgs...)
-	if err6 != nil {
-		panic(err6)
+	if err := bulkInsert(ctx, db, EventDataInsertQuery, ed_valueStrings, ed_valueArgs); err != nil {
+		return err
 	}
+	return nil
+}
 
+// bulkInsert runs query followed by all the value placeholders in one
+// statement. Nothing is sent when there are no rows.
+func bulkInsert(ctx context.Context, db database.Execer, query string, valueStrings []string, valueArgs []interface{}) error {
+	if len(valueStrings) == 0 {
+		return nil
+	}
+	_, err := database.Exec(ctx, db, query+strings.Join(valueStrings, ","), valueArgs...)
+	return err
 }
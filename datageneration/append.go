@@ -0,0 +1,114 @@
+package datageneration
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"TEST2024/database"
+)
+
+// MaxIDs is the highest ID of each source table, 0 for an empty table. New
+// rows are numbered from there.
+type MaxIDs struct {
+	CustomerID        int
+	CustomerChannelID int
+	ContentID         int
+	ContentPriceID    int
+	EventID           int
+	EventDataID       int
+}
+
+// LoadMaxIDs reads the highest ID of each source table.
+func LoadMaxIDs(ctx context.Context, db *sql.DB) (MaxIDs, error) {
+	var ids MaxIDs
+	maxIDs := []struct {
+		query string
+		dest  *int
+	}{
+		{"SELECT COALESCE(MAX(CustomerID), 0) FROM Customer", &ids.CustomerID},
+		{"SELECT COALESCE(MAX(CustomerChannelID), 0) FROM CustomerData", &ids.CustomerChannelID},
+		{"SELECT COALESCE(MAX(ContentID), 0) FROM Content", &ids.ContentID},
+		{"SELECT COALESCE(MAX(ContentPriceID), 0) FROM ContentPrice", &ids.ContentPriceID},
+		{"SELECT COALESCE(MAX(EventID), 0) FROM CustomerEvent", &ids.EventID},
+		{"SELECT COALESCE(MAX(EventDataID), 0) FROM CustomerEventData", &ids.EventDataID},
+	}
+	for _, m := range maxIDs {
+		if err := database.ScanRow(ctx, db, m.query, nil, m.dest); err != nil {
+			return ids, database.Classify("reading the max IDs", err)
+		}
+	}
+	return ids, nil
+}
+
+// existingData is what the source tables already hold. It is empty unless
+// Config.Append is set, so IDs start at 1.
+type existingData struct {
+	max           MaxIDs
+	customers     []Customer
+	contents      []Content
+	lastEventDate time.Time
+}
+
+// loadExistingData reads the current max IDs, customers and contents.
+func loadExistingData(ctx context.Context, db *sql.DB) (existingData, error) {
+	var existing existingData
+	var err error
+	if existing.max, err = LoadMaxIDs(ctx, db); err != nil {
+		return existing, err
+	}
+
+	var lastEventDate sql.NullTime
+	if err := database.ScanRow(ctx, db, "SELECT MAX(EventDate) FROM CustomerEventData", nil, &lastEventDate); err != nil {
+		return existing, database.Classify("reading the last event date", err)
+	}
+	existing.lastEventDate = lastEventDate.Time
+
+	customerCtx, cancelCustomers := database.WithQueryTimeout(ctx)
+	defer cancelCustomers()
+	rows, err := db.QueryContext(customerCtx, "SELECT CustomerID, ClientCustomerID, InsertDate FROM Customer ORDER BY CustomerID")
+	if err != nil {
+		return existing, database.Classify("reading Customer", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Customer
+		if err := rows.Scan(&c.CustomerID, &c.ClientCustomerID, &c.InsertDate); err != nil {
+			return existing, database.Classify("reading Customer", err)
+		}
+		existing.customers = append(existing.customers, c)
+	}
+	if err := rows.Err(); err != nil {
+		return existing, database.Classify("reading Customer", err)
+	}
+
+	contentCtx, cancelContents := database.WithQueryTimeout(ctx)
+	defer cancelContents()
+	contentRows, err := db.QueryContext(contentCtx, "SELECT ContentID, ClientContentID, InsertDate FROM Content ORDER BY ContentID")
+	if err != nil {
+		return existing, database.Classify("reading Content", err)
+	}
+	defer contentRows.Close()
+	for contentRows.Next() {
+		var c Content
+		if err := contentRows.Scan(&c.ContentID, &c.ClientContentID, &c.InsertDate); err != nil {
+			return existing, database.Classify("reading Content", err)
+		}
+		existing.contents = append(existing.contents, c)
+	}
+	if err := contentRows.Err(); err != nil {
+		return existing, database.Classify("reading Content", err)
+	}
+	return existing, nil
+}
+
+// nextDayRange is the whole day after last, in loc.
+func nextDayRange(last time.Time, loc *time.Location) TimeRange {
+	last = last.In(loc)
+	start := time.Date(last.Year(), last.Month(), last.Day()+1, 0, 0, 0, 0, loc)
+	return TimeRange{
+		Start:    start,
+		End:      start.AddDate(0, 0, 1),
+		Location: loc,
+	}
+}
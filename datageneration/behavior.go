@@ -0,0 +1,206 @@
+package datageneration
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"TEST2024/apperr"
+)
+
+// event types used by the generator. The analysis only counts purchases (6),
+// the funnel walks customers through views and carts before that.
+const (
+	EventTypeView     = 2
+	EventTypeCart     = 4
+	EventTypePurchase = 6
+)
+
+// ActivityModel gives the relative weight of n customers or contents.
+type ActivityModel interface {
+	Weights(r *rand.Rand, n int) []float64
+}
+
+// UniformActivity gives every customer or content the same weight.
+type UniformActivity struct{}
+
+func (UniformActivity) Weights(r *rand.Rand, n int) []float64 {
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	return weights
+}
+
+// ParetoActivity draws each weight from a Pareto distribution, so a small
+// share of customers makes most of the purchases (alpha ~1.16 gives 80/20).
+type ParetoActivity struct {
+	Alpha float64
+}
+
+func (p ParetoActivity) Weights(r *rand.Rand, n int) []float64 {
+	weights := make([]float64, n)
+	for i := range weights {
+		u := 1 - r.Float64() // (0, 1]
+		weights[i] = math.Pow(u, -1/p.Alpha)
+	}
+	return weights
+}
+
+// ZipfPopularity weights the k-th most popular item by 1/k^S. Ranks come
+// from a random key per item, so the most popular content is not always
+// ContentID 1 and adding items keeps the order of the existing ones.
+type ZipfPopularity struct {
+	S float64
+}
+
+func (z ZipfPopularity) Weights(r *rand.Rand, n int) []float64 {
+	keys := make([]float64, n)
+	order := make([]int, n)
+	for i := range keys {
+		keys[i] = r.Float64()
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return keys[order[a]] < keys[order[b]] })
+
+	weights := make([]float64, n)
+	for rank, i := range order {
+		weights[i] = 1 / math.Pow(float64(rank+1), z.S)
+	}
+	return weights
+}
+
+// SeasonalityModel gives the relative activity at a point in time.
+// Max must be an upper bound of Weight, it is used for rejection sampling.
+type SeasonalityModel interface {
+	Weight(t time.Time) float64
+	Max() float64
+}
+
+// NoSeasonality keeps activity flat over the year.
+type NoSeasonality struct{}
+
+func (NoSeasonality) Weight(t time.Time) float64 { return 1 }
+func (NoSeasonality) Max() float64               { return 1 }
+
+// CalendarSeasonality multiplies a factor per month with a factor per weekday.
+type CalendarSeasonality struct {
+	Monthly [12]float64 // January first
+	Weekday [7]float64  // Sunday first, like time.Weekday
+}
+
+func (c CalendarSeasonality) Weight(t time.Time) float64 {
+	return c.Monthly[t.Month()-1] * c.Weekday[t.Weekday()]
+}
+
+func (c CalendarSeasonality) Max() float64 {
+	maxMonth, maxDay := 0.0, 0.0
+	for _, m := range c.Monthly {
+		maxMonth = math.Max(maxMonth, m)
+	}
+	for _, d := range c.Weekday {
+		maxDay = math.Max(maxDay, d)
+	}
+	return maxMonth * maxDay
+}
+
+// FunnelModel generates sessions where a customer goes through Steps in order
+// on the same content. Continue[i] is the chance to go from Steps[i] to
+// Steps[i+1], each step happens at most MaxStepGap after the previous one.
+// Sessions only have the event types of Steps: with the steps of
+// RealisticBehavior, no event has type 1, 3 or 5.
+type FunnelModel struct {
+	Steps      []int
+	Continue   []float64
+	MaxStepGap time.Duration
+}
+
+// validate checks that every step after the first has a chance to be
+// reached and a gap to wait.
+func (f FunnelModel) validate() error {
+	if len(f.Steps) == 0 {
+		return apperr.Errorf(apperr.Config, "the funnel has no steps")
+	}
+	for _, eventType := range f.Steps {
+		if eventType < 1 || eventType > 6 {
+			return apperr.Errorf(apperr.Config, "invalid funnel event type %d, want 1 to 6", eventType)
+		}
+	}
+	if len(f.Continue) != len(f.Steps)-1 {
+		return apperr.Errorf(apperr.Config, "the funnel has %d steps, so it needs %d Continue chances, got %d", len(f.Steps), len(f.Steps)-1, len(f.Continue))
+	}
+	for _, p := range f.Continue {
+		if p < 0 || p > 1 {
+			return apperr.Errorf(apperr.Config, "invalid funnel Continue chance %v, want 0 to 1", p)
+		}
+	}
+	if len(f.Steps) > 1 && f.MaxStepGap <= 0 {
+		return apperr.Errorf(apperr.Config, "the funnel MaxStepGap is %v, it must be positive", f.MaxStepGap)
+	}
+	return nil
+}
+
+// BehaviorModel drives who buys what and when in generateEvents.
+type BehaviorModel struct {
+	Customers   ActivityModel
+	Contents    ActivityModel
+	Seasonality SeasonalityModel
+	// Funnel is used when set, otherwise every event is drawn on its own
+	// with EventTypeWeights.
+	Funnel           *FunnelModel
+	EventTypeWeights []float64
+}
+
+// UniformBehavior is the original generator: everything is drawn uniformly.
+func UniformBehavior() BehaviorModel {
+	return BehaviorModel{
+		Customers:        UniformActivity{},
+		Contents:         UniformActivity{},
+		Seasonality:      NoSeasonality{},
+		EventTypeWeights: []float64{0.1, 0.2, 0.19, 0.18, 0.165, 0.165}, // this is my choice
+	}
+}
+
+// RealisticBehavior skews customers and contents, adds a retail calendar
+// (busy end of year and weekends) and makes purchases follow views and carts.
+// Its events are views, carts and purchases only, see FunnelModel.
+func RealisticBehavior() BehaviorModel {
+	return BehaviorModel{
+		Customers: ParetoActivity{Alpha: 1.16},
+		Contents:  ZipfPopularity{S: 1.1},
+		Seasonality: CalendarSeasonality{
+			Monthly: [12]float64{0.8, 0.7, 0.85, 0.9, 0.95, 0.9, 0.85, 0.9, 1, 1.05, 1.4, 1.6},
+			Weekday: [7]float64{1.3, 0.8, 0.85, 0.9, 0.95, 1.1, 1.4},
+		},
+		Funnel: &FunnelModel{
+			Steps:      []int{EventTypeView, EventTypeCart, EventTypePurchase},
+			Continue:   []float64{0.35, 0.6},
+			MaxStepGap: 2 * time.Hour,
+		},
+	}
+}
+
+// weightedPicker draws indexes proportionally to a list of weights.
+type weightedPicker struct {
+	cumulative []float64
+}
+
+func newWeightedPicker(weights []float64) weightedPicker {
+	cumulative := make([]float64, len(weights))
+	total := 0.0
+	for i, weight := range weights {
+		total += weight
+		cumulative[i] = total
+	}
+	return weightedPicker{cumulative: cumulative}
+}
+
+func (p weightedPicker) pick(r *rand.Rand) int {
+	total := p.cumulative[len(p.cumulative)-1]
+	i := sort.SearchFloat64s(p.cumulative, r.Float64()*total)
+	if i >= len(p.cumulative) {
+		i = len(p.cumulative) - 1
+	}
+	return i
+}
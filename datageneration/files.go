@@ -0,0 +1,287 @@
+package datageneration
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"time"
+
+	"TEST2024/apperr"
+	"TEST2024/customeranalysis"
+	"TEST2024/database"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// FileFormat is the format of the files written by WriteDataset.
+type FileFormat string
+
+const (
+	FormatCSV     FileFormat = "csv"
+	FormatJSONL   FileFormat = "jsonl"
+	FormatParquet FileFormat = "parquet"
+)
+
+// ParseFileFormat checks a format name given on the command line.
+func ParseFileFormat(name string) (FileFormat, error) {
+	switch f := FileFormat(name); f {
+	case FormatCSV, FormatJSONL, FormatParquet:
+		return f, nil
+	}
+	return "", apperr.Errorf(apperr.Config, "unknown file format %q (want csv, jsonl or parquet)", name)
+}
+
+// datasetFile is the file of one table in a dataset directory, e.g. Customer.csv.
+func datasetFile(dir, table string, format FileFormat) string {
+	return filepath.Join(dir, table+"."+string(format))
+}
+
+// WriteDataset writes one file per source table in dir, named after the table.
+func WriteDataset(dir string, format FileFormat, ds Dataset) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	// each write runs only once the one before succeeded
+	err := inSequence(
+		func() error { return writeRows(datasetFile(dir, "Customer", format), format, ds.Customers) },
+		func() error { return writeRows(datasetFile(dir, "CustomerData", format), format, ds.CustomerData) },
+		func() error { return writeRows(datasetFile(dir, "Content", format), format, ds.Contents) },
+		func() error { return writeRows(datasetFile(dir, "ContentPrice", format), format, ds.ContentPrices) },
+		func() error { return writeRows(datasetFile(dir, "CustomerEvent", format), format, ds.CustomerEvents) },
+		func() error {
+			return writeRows(datasetFile(dir, "CustomerEventData", format), format, ds.CustomerEventData)
+		},
+	)
+	if err != nil {
+		return err
+	}
+	countWritten(ds)
+	return nil
+}
+
+// ReadDataset reads the files written by WriteDataset.
+func ReadDataset(dir string, format FileFormat) (Dataset, error) {
+	var ds Dataset
+	err := inSequence(
+		func() error { return readRows(datasetFile(dir, "Customer", format), format, &ds.Customers) },
+		func() error { return readRows(datasetFile(dir, "CustomerData", format), format, &ds.CustomerData) },
+		func() error { return readRows(datasetFile(dir, "Content", format), format, &ds.Contents) },
+		func() error { return readRows(datasetFile(dir, "ContentPrice", format), format, &ds.ContentPrices) },
+		func() error { return readRows(datasetFile(dir, "CustomerEvent", format), format, &ds.CustomerEvents) },
+		func() error {
+			return readRows(datasetFile(dir, "CustomerEventData", format), format, &ds.CustomerEventData)
+		},
+	)
+	return ds, err
+}
+
+// LoadDataset inserts the files written by WriteDataset into the database.
+func LoadDataset(ctx context.Context, db *sql.DB, dir string, format FileFormat) error {
+	ds, err := ReadDataset(dir, format)
+	if err != nil {
+		return err
+	}
+	err = database.InTx(ctx, db, func(tx *sql.Tx) error {
+		return InsertDataset(ctx, tx, ds)
+	})
+	if err != nil {
+		return err
+	}
+	countWritten(ds)
+	return nil
+}
+
+// inSequence runs steps in order and stops at the first error.
+func inSequence(steps ...func() error) error {
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeRows[T any](path string, format FileFormat, rows []T) error {
+	if format == FormatParquet {
+		if err := parquet.WriteFile(path, rows); err != nil {
+			return fmt.Errorf("writing %s: %w", path, err)
+		}
+		return nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	switch format {
+	case FormatCSV:
+		err = writeCSV(w, rows)
+	case FormatJSONL:
+		enc := json.NewEncoder(w)
+		for _, row := range rows {
+			if err = enc.Encode(row); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	// closed once, its error only matters when the writes went through
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
+
+func readRows[T any](path string, format FileFormat, rows *[]T) error {
+	var err error
+	if format == FormatParquet {
+		*rows, err = parquet.ReadFile[T](path)
+		if err != nil {
+			return apperr.Wrap(apperr.DataQuality, "reading "+path, err)
+		}
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch format {
+	case FormatCSV:
+		*rows, err = readCSV[T](f)
+	case FormatJSONL:
+		dec := json.NewDecoder(bufio.NewReader(f))
+		for {
+			var row T
+			if err = dec.Decode(&row); err != nil {
+				break
+			}
+			*rows = append(*rows, row)
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		return apperr.Wrap(apperr.DataQuality, "reading "+path, err)
+	}
+	return nil
+}
+
+// writeCSV writes a header with the field names, then one record per row.
+// Dates are written as RFC 3339 so the time zone is kept.
+func writeCSV[T any](w io.Writer, rows []T) error {
+	cw := csv.NewWriter(w)
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	header := make([]string, t.NumField())
+	for i := range header {
+		header[i] = t.Field(i).Name
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	record := make([]string, len(header))
+	for _, row := range rows {
+		v := reflect.ValueOf(row)
+		for i := range record {
+			switch field := v.Field(i).Interface().(type) {
+			case int:
+				record[i] = strconv.Itoa(field)
+			case float64:
+				record[i] = strconv.FormatFloat(field, 'f', -1, 64)
+			case customeranalysis.Money:
+				record[i] = field.String()
+			case string:
+				record[i] = field
+			case time.Time:
+				record[i] = field.Format(time.RFC3339Nano)
+			default:
+				return apperr.Errorf(apperr.DataQuality, "unsupported field %s", header[i])
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// readCSV reads records written by writeCSV, matching columns by header name.
+func readCSV[T any](r io.Reader) ([]T, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	fields := make([]int, len(header))
+	for i, name := range header {
+		field, ok := t.FieldByName(name)
+		if !ok {
+			return nil, apperr.Errorf(apperr.DataQuality, "unknown column %s", name)
+		}
+		fields[i] = field.Index[0]
+	}
+
+	var rows []T
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var row T
+		v := reflect.ValueOf(&row).Elem()
+		for i, value := range record {
+			field := v.Field(fields[i])
+			switch field.Interface().(type) {
+			case int:
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("column %s: %w", header[i], err)
+				}
+				field.SetInt(int64(n))
+			case float64:
+				f, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return nil, fmt.Errorf("column %s: %w", header[i], err)
+				}
+				field.SetFloat(f)
+			case customeranalysis.Money:
+				m, err := customeranalysis.ParseMoney(value)
+				if err != nil {
+					return nil, fmt.Errorf("column %s: %w", header[i], err)
+				}
+				field.SetInt(int64(m))
+			case string:
+				field.SetString(value)
+			case time.Time:
+				d, err := time.Parse(time.RFC3339Nano, value)
+				if err != nil {
+					return nil, fmt.Errorf("column %s: %w", header[i], err)
+				}
+				field.Set(reflect.ValueOf(d))
+			}
+		}
+		rows = append(rows, row)
+	}
+}
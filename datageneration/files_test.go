@@ -0,0 +1,80 @@
+package datageneration
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDataset() Dataset {
+	at := func(day, nanos int) time.Time { return time.Date(2023, 11, day, 13, 4, 5, nanos, time.UTC) }
+	return Dataset{
+		Customers: []Customer{
+			{CustomerID: 1, ClientCustomerID: "C-1", InsertDate: at(1, 0)},
+			{CustomerID: 2, ClientCustomerID: `quoted "name", with a comma`, InsertDate: at(2, 123456789)},
+		},
+		CustomerData: []CustomerData{
+			{CustomerChannelID: 1, CustomerID: 1, ChannelTypeID: 1, ChannelValue: "a@example.com", InsertDate: at(1, 0)},
+			{CustomerChannelID: 2, CustomerID: 2, ChannelTypeID: 2, ChannelValue: "", InsertDate: at(2, 1)},
+		},
+		Contents: []Content{
+			{ContentID: 7, ClientContentID: "0042", InsertDate: at(3, 0)},
+		},
+		ContentPrices: []ContentPrice{
+			{ContentPriceID: 1, ContentID: 7, Price: 123456, Currency: "USD", InsertDate: at(3, 0)},
+			{ContentPriceID: 2, ContentID: 7, Price: 1, Currency: "EUR", InsertDate: at(4, 0)},
+		},
+		CustomerEvents: []CustomerEvent{
+			{EventID: 1, ClientEventID: "E-1", InsertDate: at(5, 0)},
+		},
+		CustomerEventData: []CustomerEventData{
+			{EventDataID: 1, EventID: 1, ContentID: 7, CustomerID: 2, EventTypeID: 6, EventDate: at(5, 0), Quantity: 3, InsertDate: at(5, 999)},
+		},
+	}
+}
+
+func TestDatasetRoundTrip(t *testing.T) {
+	want := testDataset()
+	for _, format := range []FileFormat{FormatCSV, FormatJSONL, FormatParquet} {
+		dir := t.TempDir()
+		if err := WriteDataset(dir, format, want); err != nil {
+			t.Fatalf("%s: WriteDataset: %v", format, err)
+		}
+		got, err := ReadDataset(dir, format)
+		if err != nil {
+			t.Fatalf("%s: ReadDataset: %v", format, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: read back\n%+v\nwant\n%+v", format, got, want)
+		}
+	}
+}
+
+func TestReadDatasetErrors(t *testing.T) {
+	// the first missing file stops the read
+	_, err := ReadDataset(t.TempDir(), FormatCSV)
+	if err == nil || !strings.Contains(err.Error(), "Customer.csv") {
+		t.Errorf("ReadDataset of an empty directory: %v, want an error on Customer.csv", err)
+	}
+
+	dir := t.TempDir()
+	if err := WriteDataset(dir, FormatCSV, testDataset()); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "ContentPrice.csv")
+	if err := os.WriteFile(path, []byte("ContentPriceID,Discount\n1,5\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadDataset(dir, FormatCSV); err == nil || !strings.Contains(err.Error(), "unknown column Discount") {
+		t.Errorf("ReadDataset with an unknown column: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("ContentPriceID,Price\n1,abc\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadDataset(dir, FormatCSV); err == nil || !strings.Contains(err.Error(), "column Price") {
+		t.Errorf("ReadDataset with an invalid price: %v", err)
+	}
+}
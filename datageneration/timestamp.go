@@ -0,0 +1,74 @@
+package datageneration
+
+import (
+	"math/rand"
+	"time"
+)
+
+// TimeRange is the [Start, End) interval generated dates fall in. Dates are
+// expressed in Location, which also decides the month and weekday used by
+// the seasonality models (UTC when nil).
+type TimeRange struct {
+	Start    time.Time
+	End      time.Time
+	Location *time.Location
+}
+
+// YearRange covers the whole year in loc.
+func YearRange(year int, loc *time.Location) TimeRange {
+	return TimeRange{
+		Start:    time.Date(year, time.January, 1, 0, 0, 0, 0, loc),
+		End:      time.Date(year+1, time.January, 1, 0, 0, 0, 0, loc),
+		Location: loc,
+	}
+}
+
+func (tr TimeRange) location() *time.Location {
+	if tr.Location == nil {
+		return time.UTC
+	}
+	return tr.Location
+}
+
+// randomTimestamp draws a timestamp uniformly in the range, to the second.
+func randomTimestamp(r *rand.Rand, tr TimeRange) time.Time {
+	seconds := int64(tr.End.Sub(tr.Start) / time.Second)
+	if seconds <= 0 {
+		return tr.Start.In(tr.location())
+	}
+	return tr.Start.Add(time.Duration(r.Int63n(seconds)) * time.Second).In(tr.location())
+}
+
+// hasActivity tells if s gives a positive weight somewhere in the range,
+// checked every hour. Otherwise seasonalTimestamp would never return.
+func hasActivity(tr TimeRange, s SeasonalityModel) bool {
+	if s.Max() <= 0 {
+		return false
+	}
+	for t := tr.Start; t.Before(tr.End); t = t.Add(time.Hour) {
+		if s.Weight(t.In(tr.location())) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// seasonalTimestamp draws a timestamp in the range, keeping it with a
+// probability proportional to the seasonality weight.
+func seasonalTimestamp(r *rand.Rand, tr TimeRange, s SeasonalityModel) time.Time {
+	for {
+		t := randomTimestamp(r, tr)
+		if r.Float64()*s.Max() <= s.Weight(t) {
+			return t
+		}
+	}
+}
+
+// insertDateAfter returns when an event at eventDate reaches the database:
+// between eventDate and eventDate+maxDelay.
+func insertDateAfter(r *rand.Rand, eventDate time.Time, maxDelay time.Duration) time.Time {
+	if maxDelay <= 0 {
+		return eventDate
+	}
+	return eventDate.Add(time.Duration(r.Int63n(int64(maxDelay)/int64(time.Second)+1)) * time.Second)
+}
@@ -0,0 +1,484 @@
+package dataimport
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"TEST2024/apperr"
+	"TEST2024/database"
+	"TEST2024/datageneration"
+)
+
+// Kind is one of the files an import reads. Files are loaded in the order of
+// Kinds, so events can refer to customers and contents of the same import.
+type Kind string
+
+const (
+	KindCustomers Kind = "customers" // ClientCustomerID, InsertDate
+	KindChannels  Kind = "channels"  // ClientCustomerID, ChannelTypeID, ChannelValue, InsertDate
+	KindContents  Kind = "contents"  // ClientContentID, InsertDate
+	KindPrices    Kind = "prices"    // ClientContentID, Price, Currency, InsertDate
+	KindEvents    Kind = "events"    // ClientEventID, ClientCustomerID, ClientContentID, EventTypeID, EventDate, Quantity, InsertDate
+)
+
+var Kinds = []Kind{KindCustomers, KindChannels, KindContents, KindPrices, KindEvents}
+
+// kindFields are the fields read from the files of each kind.
+var kindFields = map[Kind][]string{
+	KindCustomers: {"ClientCustomerID", "InsertDate"},
+	KindChannels:  {"ClientCustomerID", "ChannelTypeID", "ChannelValue", "InsertDate"},
+	KindContents:  {"ClientContentID", "InsertDate"},
+	KindPrices:    {"ClientContentID", "Price", "Currency", "InsertDate"},
+	KindEvents:    {"ClientEventID", "ClientCustomerID", "ClientContentID", "EventTypeID", "EventDate", "Quantity", "InsertDate"},
+}
+
+// Options describes an import. Files maps each kind to a .csv or .jsonl
+// file, kinds without a file are skipped.
+type Options struct {
+	Files map[Kind]string
+	// Mapping renames columns: Mapping[kind][field] is the column holding
+	// field. Fields without a mapping are read from the column of that name.
+	Mapping map[Kind]map[string]string
+	// BatchSize is the number of rows committed together with the checkpoint.
+	BatchSize int
+	// Restart forgets the checkpoints and reads the files from the start.
+	Restart bool
+	// ErrorReport is a CSV file receiving the rejected rows, if set. It is
+	// written even when the import fails, and appended to, so the rows
+	// rejected before an interruption stay in it; Restart starts it over.
+	ErrorReport string
+}
+
+// RowError is a rejected row. Field is empty when the whole row is unreadable.
+type RowError struct {
+	Kind    Kind
+	File    string
+	Line    int
+	Field   string
+	Message string
+}
+
+// Report counts what happened to the rows of each kind.
+type Report struct {
+	Inserted   map[Kind]int
+	Duplicates map[Kind]int // rows whose client ID is already known
+	Rejected   map[Kind]int
+	Skipped    map[Kind]int // rows already loaded by a previous run
+	Errors     []RowError
+}
+
+// ParseMapping adds a "kind.Field=column" mapping, e.g.
+// "customers.ClientCustomerID=customer_ref".
+func ParseMapping(spec string, mapping map[Kind]map[string]string) error {
+	target, column, ok := strings.Cut(spec, "=")
+	kind, field, ok2 := strings.Cut(target, ".")
+	if !ok || !ok2 || field == "" || column == "" {
+		return apperr.Errorf(apperr.Config, "bad mapping %q, want kind.Field=column", spec)
+	}
+	if !knownKind(Kind(kind)) {
+		return apperr.Errorf(apperr.Config, "bad mapping %q, unknown file kind %q", spec, kind)
+	}
+	if !knownField(Kind(kind), field) {
+		return apperr.Errorf(apperr.Config, "bad mapping %q, %s files have no field %q (want one of %s)",
+			spec, kind, field, strings.Join(kindFields[Kind(kind)], ", "))
+	}
+	if mapping[Kind(kind)] == nil {
+		mapping[Kind(kind)] = make(map[string]string)
+	}
+	mapping[Kind(kind)][field] = column
+	return nil
+}
+
+type importer struct {
+	db     *sql.DB
+	opts   Options
+	report *Report
+	now    time.Time
+
+	// client ID -> internal ID, for dedup and to resolve references
+	customers map[string]int
+	contents  map[string]int
+	events    map[string]int
+
+	max datageneration.MaxIDs
+	// rows rejected in the batch in progress, reported once it is committed
+	pending []RowError
+}
+
+// Import loads the files of opts into the six source tables. Rows are
+// committed in batches together with a checkpoint, so an interrupted import
+// continues where it stopped when run again. Cancelling ctx rolls back the
+// batch in progress.
+func Import(ctx context.Context, db *sql.DB, opts Options) (Report, error) {
+	report := Report{
+		Inserted:   make(map[Kind]int),
+		Duplicates: make(map[Kind]int),
+		Rejected:   make(map[Kind]int),
+		Skipped:    make(map[Kind]int),
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	for kind := range opts.Files {
+		if !knownKind(kind) {
+			return report, apperr.Errorf(apperr.Config, "unknown file kind %q", kind)
+		}
+	}
+
+	im := &importer{db: db, opts: opts, report: &report, now: time.Now()}
+	err := im.run(ctx)
+	if opts.ErrorReport != "" {
+		// a resumed run skips the rows rejected before, so it appends
+		if reportErr := writeErrorReport(opts.ErrorReport, report.Errors, !opts.Restart); reportErr != nil && err == nil {
+			err = reportErr
+		}
+	}
+	return report, err
+}
+
+// run loads every file of the import, in the order of Kinds.
+func (im *importer) run(ctx context.Context) error {
+	if err := im.loadState(ctx); err != nil {
+		return err
+	}
+	_, err := database.Exec(ctx, im.db, `
+	CREATE TABLE IF NOT EXISTS ImportCheckpoint (
+		Source VARCHAR(512) PRIMARY KEY,
+		RowsDone INT
+	);`)
+	if err != nil {
+		return fmt.Errorf("error creating ImportCheckpoint table: %w", err)
+	}
+
+	for _, kind := range Kinds {
+		path, ok := im.opts.Files[kind]
+		if !ok {
+			continue
+		}
+		if err := im.importFile(ctx, kind, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func knownKind(kind Kind) bool {
+	for _, k := range Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func knownField(kind Kind, field string) bool {
+	for _, f := range kindFields[kind] {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// loadState reads the client IDs and max IDs already in the database.
+func (im *importer) loadState(ctx context.Context) error {
+	var err error
+	if im.customers, err = clientIDs(ctx, im.db, "SELECT ClientCustomerID, CustomerID FROM Customer"); err != nil {
+		return err
+	}
+	if im.contents, err = clientIDs(ctx, im.db, "SELECT ClientContentID, ContentID FROM Content"); err != nil {
+		return err
+	}
+	if im.events, err = clientIDs(ctx, im.db, "SELECT ClientEventID, EventID FROM CustomerEvent"); err != nil {
+		return err
+	}
+	im.max, err = datageneration.LoadMaxIDs(ctx, im.db)
+	return err
+}
+
+func clientIDs(ctx context.Context, db *sql.DB, query string) (map[string]int, error) {
+	ctx, cancel := database.WithQueryTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, database.Classify("reading the client IDs", err)
+	}
+	defer rows.Close()
+
+	ids := make(map[string]int)
+	for rows.Next() {
+		var clientID string
+		var id int
+		if err := rows.Scan(&clientID, &id); err != nil {
+			return nil, database.Classify("reading the client IDs", err)
+		}
+		ids[clientID] = id
+	}
+	if err := rows.Err(); err != nil {
+		return nil, database.Classify("reading the client IDs", err)
+	}
+	return ids, nil
+}
+
+// importFile loads one file in batches, skipping the rows a previous run
+// already committed.
+func (im *importer) importFile(ctx context.Context, kind Kind, path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	source := string(kind) + ":" + abs
+
+	done := 0
+	if im.opts.Restart {
+		if _, err := database.Exec(ctx, im.db, "DELETE FROM ImportCheckpoint WHERE Source = ?", source); err != nil {
+			return err
+		}
+	} else {
+		err := database.ScanRow(ctx, im.db, "SELECT RowsDone FROM ImportCheckpoint WHERE Source = ?", []interface{}{source}, &done)
+		if err != nil && err != sql.ErrNoRows {
+			return database.Classify("reading the import checkpoint", err)
+		}
+	}
+
+	rr, err := openRecords(path)
+	if err != nil {
+		return err
+	}
+	defer rr.Close()
+
+	var batch datageneration.Dataset
+	rowsRead, batchRows := 0, 0
+	for {
+		rec, err := rr.next()
+		if err == io.EOF {
+			break
+		}
+		if _, bad := err.(badRowError); err != nil && !bad {
+			return apperr.Wrap(apperr.DataQuality, "reading "+path, err)
+		}
+		rowsRead++
+		if rowsRead <= done {
+			im.report.Skipped[kind]++
+			continue
+		}
+		if err != nil {
+			im.report.Rejected[kind]++
+			im.reject(kind, path, rec.line, "", err.Error())
+		} else {
+			im.addRow(kind, path, rec, &batch)
+		}
+
+		batchRows++
+		if batchRows == im.opts.BatchSize {
+			if err := im.commit(ctx, source, rowsRead, batch); err != nil {
+				return err
+			}
+			batch, batchRows = datageneration.Dataset{}, 0
+		}
+	}
+	if batchRows > 0 {
+		return im.commit(ctx, source, rowsRead, batch)
+	}
+	return nil
+}
+
+// commit inserts a batch and moves the checkpoint in the same transaction.
+// The rows the batch rejected are reported once it is committed: a batch
+// rolled back is read again by the next run, which rejects them again.
+func (im *importer) commit(ctx context.Context, source string, rowsDone int, batch datageneration.Dataset) error {
+	err := database.InTx(ctx, im.db, func(tx *sql.Tx) error {
+		if err := datageneration.InsertDataset(ctx, tx, batch); err != nil {
+			return fmt.Errorf("inserting rows of %s: %w", source, err)
+		}
+		_, err := database.Exec(ctx, tx, `INSERT INTO ImportCheckpoint (Source, RowsDone) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE RowsDone = VALUES(RowsDone)`, source, rowsDone)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	im.report.Errors = append(im.report.Errors, im.pending...)
+	im.pending = nil
+	return nil
+}
+
+func (im *importer) reject(kind Kind, path string, line int, field, message string) {
+	im.pending = append(im.pending, RowError{Kind: kind, File: path, Line: line, Field: field, Message: message})
+}
+
+// addRow validates a row and adds it to the batch, or reports why it is rejected.
+func (im *importer) addRow(kind Kind, path string, rec record, batch *datageneration.Dataset) {
+	p := &rowParser{rec: rec, columns: im.opts.Mapping[kind]}
+	var add func()
+
+	switch kind {
+	case KindCustomers:
+		clientID := p.str("ClientCustomerID", true)
+		insertDate := p.date("InsertDate", im.now)
+		if _, exists := im.customers[clientID]; exists && len(p.errs) == 0 {
+			im.report.Duplicates[kind]++
+			return
+		}
+		add = func() {
+			im.max.CustomerID++
+			im.customers[clientID] = im.max.CustomerID
+			batch.Customers = append(batch.Customers, datageneration.Customer{
+				CustomerID:       im.max.CustomerID,
+				ClientCustomerID: clientID,
+				InsertDate:       insertDate,
+			})
+		}
+
+	case KindChannels:
+		customerID := im.reference(p, "ClientCustomerID", im.customers)
+		channelType := p.integer("ChannelTypeID", 1, 5)
+		value := p.str("ChannelValue", true)
+		insertDate := p.date("InsertDate", im.now)
+		add = func() {
+			im.max.CustomerChannelID++
+			batch.CustomerData = append(batch.CustomerData, datageneration.CustomerData{
+				CustomerChannelID: im.max.CustomerChannelID,
+				CustomerID:        customerID,
+				ChannelTypeID:     channelType,
+				ChannelValue:      value,
+				InsertDate:        insertDate,
+			})
+		}
+
+	case KindContents:
+		clientID := p.str("ClientContentID", true)
+		insertDate := p.date("InsertDate", im.now)
+		if _, exists := im.contents[clientID]; exists && len(p.errs) == 0 {
+			im.report.Duplicates[kind]++
+			return
+		}
+		add = func() {
+			im.max.ContentID++
+			im.contents[clientID] = im.max.ContentID
+			batch.Contents = append(batch.Contents, datageneration.Content{
+				ContentID:       im.max.ContentID,
+				ClientContentID: clientID,
+				InsertDate:      insertDate,
+			})
+		}
+
+	case KindPrices:
+		contentID := im.reference(p, "ClientContentID", im.contents)
+		price := p.price("Price")
+		currency := p.str("Currency", false)
+		if currency == "" {
+			currency = "USD"
+		}
+		insertDate := p.date("InsertDate", im.now)
+		add = func() {
+			im.max.ContentPriceID++
+			batch.ContentPrices = append(batch.ContentPrices, datageneration.ContentPrice{
+				ContentPriceID: im.max.ContentPriceID,
+				ContentID:      contentID,
+				Price:          price,
+				Currency:       currency,
+				InsertDate:     insertDate,
+			})
+		}
+
+	case KindEvents:
+		clientID := p.str("ClientEventID", true)
+		customerID := im.reference(p, "ClientCustomerID", im.customers)
+		contentID := im.reference(p, "ClientContentID", im.contents)
+		eventType := p.integer("EventTypeID", 1, 6)
+		eventDate := p.date("EventDate", time.Time{})
+		quantity := p.integer("Quantity", 1, 1000000)
+		insertDate := p.date("InsertDate", eventDate)
+		if insertDate.Before(eventDate) {
+			p.fail("InsertDate", "before EventDate")
+		}
+		if _, exists := im.events[clientID]; exists && len(p.errs) == 0 {
+			im.report.Duplicates[kind]++
+			return
+		}
+		add = func() {
+			im.max.EventID++
+			im.max.EventDataID++
+			im.events[clientID] = im.max.EventID
+			batch.CustomerEvents = append(batch.CustomerEvents, datageneration.CustomerEvent{
+				EventID:       im.max.EventID,
+				ClientEventID: clientID,
+				InsertDate:    insertDate,
+			})
+			batch.CustomerEventData = append(batch.CustomerEventData, datageneration.CustomerEventData{
+				EventDataID: im.max.EventDataID,
+				EventID:     im.max.EventID,
+				ContentID:   contentID,
+				CustomerID:  customerID,
+				EventTypeID: eventType,
+				EventDate:   eventDate,
+				Quantity:    quantity,
+				InsertDate:  insertDate,
+			})
+		}
+	}
+
+	if len(p.errs) > 0 {
+		im.report.Rejected[kind]++
+		for _, e := range p.errs {
+			im.reject(kind, path, rec.line, e.field, e.message)
+		}
+		return
+	}
+	add()
+	im.report.Inserted[kind]++
+}
+
+// reference resolves a client ID read from field into an internal ID.
+func (im *importer) reference(p *rowParser, field string, ids map[string]int) int {
+	clientID := p.str(field, true)
+	if clientID == "" {
+		return 0
+	}
+	id, ok := ids[clientID]
+	if !ok {
+		p.fail(field, "unknown %s %q", field, clientID)
+	}
+	return id
+}
+
+// writeErrorReport writes errs to the CSV file at path. With appendTo the
+// rows are added after those already in the file, and the header is only
+// written to a new file.
+func writeErrorReport(path string, errs []RowError, appendTo bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendTo {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(f)
+	if info.Size() == 0 {
+		w.Write([]string{"Kind", "File", "Line", "Field", "Error"})
+	}
+	for _, e := range errs {
+		w.Write([]string{string(e.Kind), e.File, strconv.Itoa(e.Line), e.Field, e.Message})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
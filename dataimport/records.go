@@ -0,0 +1,218 @@
+package dataimport
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"TEST2024/apperr"
+	"TEST2024/customeranalysis"
+)
+
+// record is one row of an input file, by column name.
+type record struct {
+	line   int
+	values map[string]string
+}
+
+// recordReader reads the rows of a CSV file (with a header) or a JSON Lines
+// file (one object per line). The format comes from the file extension.
+type recordReader struct {
+	file   *os.File
+	csv    *csv.Reader
+	header []string
+	lines  *bufio.Scanner
+	line   int // line of the last row returned
+}
+
+func openRecords(path string) (*recordReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	rr := &recordReader{file: f}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		rr.csv = csv.NewReader(f)
+		rr.csv.FieldsPerRecord = -1 // short rows are reported per row
+		rr.header, err = rr.csv.Read()
+		if err != nil {
+			f.Close()
+			return nil, apperr.Wrap(apperr.DataQuality, "reading header of "+path, err)
+		}
+	case ".jsonl", ".ndjson":
+		rr.lines = bufio.NewScanner(f)
+		rr.lines.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	default:
+		f.Close()
+		return nil, apperr.Errorf(apperr.Config, "%s: unknown extension, want .csv or .jsonl", path)
+	}
+	return rr, nil
+}
+
+// badRowError is a row that cannot be read at all. It is reported and
+// skipped, any other error stops the import.
+type badRowError struct {
+	err error
+}
+
+func (e badRowError) Error() string { return e.err.Error() }
+
+// next returns the next row, or io.EOF.
+func (rr *recordReader) next() (record, error) {
+	if rr.csv != nil {
+		values, err := rr.csv.Read()
+		if perr, ok := err.(*csv.ParseError); ok {
+			rr.line = perr.StartLine
+			return record{line: rr.line}, badRowError{perr}
+		}
+		if err != nil {
+			return record{}, err
+		}
+		rr.line, _ = rr.csv.FieldPos(0)
+		rec := record{line: rr.line, values: make(map[string]string, len(rr.header))}
+		for i, column := range rr.header {
+			if i < len(values) {
+				rec.values[column] = values[i]
+			}
+		}
+		return rec, nil
+	}
+
+	for rr.lines.Scan() {
+		rr.line++
+		text := strings.TrimSpace(rr.lines.Text())
+		if text == "" {
+			continue
+		}
+		rec := record{line: rr.line, values: make(map[string]string)}
+		dec := json.NewDecoder(strings.NewReader(text))
+		dec.UseNumber()
+		var object map[string]interface{}
+		if err := dec.Decode(&object); err != nil {
+			return rec, badRowError{err}
+		}
+		for column, value := range object {
+			switch v := value.(type) {
+			case nil:
+			case string:
+				rec.values[column] = v
+			case json.Number:
+				rec.values[column] = v.String()
+			default:
+				rec.values[column] = fmt.Sprint(v)
+			}
+		}
+		return rec, nil
+	}
+	if err := rr.lines.Err(); err != nil {
+		return record{line: rr.line}, err
+	}
+	return record{}, io.EOF
+}
+
+func (rr *recordReader) Close() error {
+	return rr.file.Close()
+}
+
+// timeLayouts are the date formats accepted in input files.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// rowParser reads typed fields out of a record, collecting one error per
+// bad field instead of stopping at the first one.
+type rowParser struct {
+	rec     record
+	columns map[string]string // field -> column, from the mapping
+	errs    []fieldError
+}
+
+type fieldError struct {
+	field   string
+	message string
+}
+
+func (p *rowParser) raw(field string) string {
+	column, ok := p.columns[field]
+	if !ok {
+		column = field
+	}
+	return strings.TrimSpace(p.rec.values[column])
+}
+
+func (p *rowParser) fail(field, format string, args ...interface{}) {
+	p.errs = append(p.errs, fieldError{field: field, message: fmt.Sprintf(format, args...)})
+}
+
+func (p *rowParser) str(field string, required bool) string {
+	v := p.raw(field)
+	if v == "" && required {
+		p.fail(field, "missing value")
+	}
+	return v
+}
+
+func (p *rowParser) integer(field string, min, max int) int {
+	v := p.raw(field)
+	if v == "" {
+		p.fail(field, "missing value")
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		p.fail(field, "%q is not an integer", v)
+		return 0
+	}
+	if n < min || n > max {
+		p.fail(field, "%d is out of range [%d, %d]", n, min, max)
+	}
+	return n
+}
+
+// price reads field exactly, to the 4 decimals of the Price column.
+func (p *rowParser) price(field string) customeranalysis.Money {
+	v := p.raw(field)
+	if v == "" {
+		p.fail(field, "missing value")
+		return 0
+	}
+	m, err := customeranalysis.ParseMoney(v)
+	if err != nil {
+		p.fail(field, "%q is not a number", v)
+		return 0
+	}
+	if m < 0 {
+		p.fail(field, "negative price %v", m)
+	}
+	return m
+}
+
+// date parses field, using fallback when the value is empty and fallback is
+// not zero.
+func (p *rowParser) date(field string, fallback time.Time) time.Time {
+	v := p.raw(field)
+	if v == "" {
+		if fallback.IsZero() {
+			p.fail(field, "missing value")
+		}
+		return fallback
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t
+		}
+	}
+	p.fail(field, "%q is not a date", v)
+	return fallback
+}
@@ -1,20 +1,594 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"TEST2024/apperr"
 	"TEST2024/customeranalysis"
 	"TEST2024/database"
 	"TEST2024/datageneration"
+	"TEST2024/dataimport"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
+const usage = `usage: TEST2024 [command] [flags]
+
+commands:
+  run       generate data into MySQL then run the analysis (default)
+  analyze   run the analysis on the data already in MySQL
+  report    render the analysis as a self-contained HTML file
+  generate  generate data into MySQL, or into files with -out
+  load      insert files written by generate -out into MySQL
+  import    load customer, channel, content, price and event files into MySQL
+  backtest  measure the revenue forecasts on the last days of data
+
+run "TEST2024 <command> -h" for the flags of a command. Every command logs
+to stderr (-log-level, -log-format text or json, -run-id) and can publish
+Prometheus metrics (-metrics-file, -metrics-addr, -metrics-wait).
+
+exit codes:
+  0    success
+  1    other failure
+  2    invalid command, flags or paths
+  3    MySQL cannot be reached or refused the login
+  4    a query failed or timed out
+  5    the data holds values that cannot be used
+  130  interrupted
+`
+
 func main() {
+	command, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	// Ctrl-C or a stop cancels the queries in flight and rolls back the open
+	// transactions, so the tables are left as they were.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	commands := map[string]func(context.Context, []string) error{
+		"run":      runCommand,
+		"analyze":  analyzeCommand,
+		"report":   reportCommand,
+		"generate": generateCommand,
+		"load":     loadCommand,
+		"import":   importCommand,
+		"backtest": backtestCommand,
+	}
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	err := run(ctx, args)
+	if endErr := tel.end(ctx, err); err == nil {
+		err = endErr
+	}
+	if err != nil {
+		stop()
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCode maps the failures of a command to the exit codes of the usage.
+func exitCode(err error) int {
+	if errors.Is(err, context.Canceled) {
+		return 130
+	}
+	switch apperr.KindOf(err) {
+	case apperr.Config:
+		return 2
+	case apperr.Connection:
+		return 3
+	case apperr.Query:
+		return 4
+	case apperr.DataQuality:
+		return 5
+	}
+	return 1
+}
+
+// databaseFlags registers the flags of the commands using MySQL.
+func databaseFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&database.QueryTimeout, "query-timeout", 10*time.Minute, "longest time a single query may run, 0 for no limit")
+}
+
+// generationFlags registers the flags shared by run and generate. The
+// returned function builds the config once the flags are parsed.
+func generationFlags(fs *flag.FlagSet) func() (datageneration.Config, error) {
+	cfg := datageneration.DefaultConfig()
+	fs.BoolVar(&cfg.Append, "append", false, "append to the data already in the source tables")
+	fs.BoolVar(&cfg.NextDay, "next-day", false, "with -append, generate the day after the latest event")
+	fs.IntVar(&cfg.Customers, "customers", cfg.Customers, "number of new customers")
+	fs.IntVar(&cfg.Contents, "contents", cfg.Contents, "number of new contents")
+	fs.IntVar(&cfg.Events, "events", cfg.Events, "number of events to generate")
+	from := fs.String("from", cfg.Range.Start.Format(dateLayout), "first day of the generated dates, or YYYY-MM-DDTHH:MM:SS")
+	to := fs.String("to", cfg.Range.End.Format(dateLayout), "end of the generated dates, excluded, or YYYY-MM-DDTHH:MM:SS")
+	tz := fs.String("tz", cfg.Range.Location.String(), "time zone of -from and -to, also deciding the months and weekdays of the seasonality")
+	fs.Func("session-steps", "comma separated event types of the generated sessions, the only types generated (default 2,4,6)", func(s string) error {
+		var steps []int
+		for _, field := range strings.Split(s, ",") {
+			step, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				return fmt.Errorf("invalid event type %q", field)
+			}
+			steps = append(steps, step)
+		}
+		cfg.Behavior.Funnel.Steps = steps
+		return nil
+	})
+	fs.Func("session-continue", "comma separated chances to go on to the next session step (default 0.35,0.6)", func(s string) error {
+		var chances []float64
+		for _, field := range strings.Split(s, ",") {
+			p, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				return fmt.Errorf("invalid chance %q", field)
+			}
+			chances = append(chances, p)
+		}
+		cfg.Behavior.Funnel.Continue = chances
+		return nil
+	})
+	return func() (datageneration.Config, error) {
+		if cfg.NextDay && !cfg.Append {
+			return cfg, apperr.Errorf(apperr.Config, "-next-day continues the existing data, it needs -append")
+		}
+		loc, err := time.LoadLocation(*tz)
+		if err != nil {
+			return cfg, apperr.Wrap(apperr.Config, "-tz", err)
+		}
+		rangeSet := false
+		fs.Visit(func(f *flag.Flag) { rangeSet = rangeSet || f.Name == "from" || f.Name == "to" })
+		if rangeSet && cfg.NextDay {
+			return cfg, apperr.Errorf(apperr.Config, "-next-day picks the day to generate, -from and -to cannot be used with it")
+		}
+		cfg.Range.Location = loc
+		if cfg.Range.Start, err = parseRangeTime("-from", *from, loc); err != nil {
+			return cfg, err
+		}
+		if cfg.Range.End, err = parseRangeTime("-to", *to, loc); err != nil {
+			return cfg, err
+		}
+		if !cfg.Range.Start.Before(cfg.Range.End) {
+			return cfg, apperr.Errorf(apperr.Config, "-from %s is not before -to %s", *from, *to)
+		}
+		return cfg, cfg.Validate()
+	}
+}
+
+const dateLayout = "2006-01-02"
+
+// parseRangeTime reads a -from or -to value, a date or a date and time,
+// in loc.
+func parseRangeTime(name, value string, loc *time.Location) (time.Time, error) {
+	for _, layout := range []string{dateLayout, "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, apperr.Errorf(apperr.Config, "invalid %s %q, want YYYY-MM-DD or YYYY-MM-DDTHH:MM:SS", name, value)
+}
+
+// optionsFlags registers the computation flags shared by run, analyze, report
+// and backtest. The returned function builds the options once the flags are
+// parsed.
+func optionsFlags(fs *flag.FlagSet) func() (customeranalysis.Options, error) {
+	opts := customeranalysis.DefaultOptions()
+	fs.Func("clv-model", "customer lifetime value model: bgnbd or heuristic (default bgnbd)", func(s string) error {
+		switch model := customeranalysis.CLVModel(s); model {
+		case customeranalysis.CLVProbabilistic, customeranalysis.CLVHeuristic:
+			opts.CLV.Model = model
+			return nil
+		}
+		return fmt.Errorf("unknown model %q", s)
+	})
+	fs.Float64Var(&opts.CLV.HorizonDays, "clv-horizon", opts.CLV.HorizonDays, "days of purchases the lifetime value predicts")
+	fs.Float64Var(&opts.CLV.Retention, "clv-retention", opts.CLV.Retention, "share of the purchase rate kept by the heuristic model")
+	fs.Func("funnel", "comma separated event types of the funnel steps (default 2,4,6)", func(s string) error {
+		var steps []int
+		for _, field := range strings.Split(s, ",") {
+			step, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || step < 1 || step > 6 {
+				return fmt.Errorf("invalid event type %q", field)
+			}
+			steps = append(steps, step)
+		}
+		opts.Funnel.Steps = steps
+		return nil
+	})
+	fs.DurationVar(&opts.Funnel.Window, "funnel-window", opts.Funnel.Window, "time allowed from the first funnel step to the last")
+	fs.Float64Var(&opts.Basket.MinSupport, "min-support", opts.Basket.MinSupport, "minimum share of customers buying both contents of a rule")
+	fs.Float64Var(&opts.Basket.MinConfidence, "min-confidence", opts.Basket.MinConfidence, "minimum confidence of a co-purchase rule")
+	fs.IntVar(&opts.Basket.TopRules, "top-rules", opts.Basket.TopRules, "number of co-purchase rules kept, 0 for all")
+	fs.Func("series", "sales time series period: day, week or month (default day)", func(s string) error {
+		switch g := customeranalysis.Granularity(s); g {
+		case customeranalysis.Daily, customeranalysis.Weekly, customeranalysis.Monthly:
+			opts.Series.Granularity = g
+			return nil
+		}
+		return fmt.Errorf("unknown period %q", s)
+	})
+	fs.Func("series-split", "split the sales time series by none, content or channel (default none)", func(s string) error {
+		switch split := customeranalysis.SeriesSplit(s); split {
+		case customeranalysis.SplitNone, customeranalysis.SplitContent, customeranalysis.SplitChannel:
+			opts.Series.Split = split
+			return nil
+		}
+		return fmt.Errorf("unknown split %q", s)
+	})
+	fs.IntVar(&opts.Series.MovingAverage, "moving-average", opts.Series.MovingAverage, "periods in the revenue moving average")
+	minIntFlag(fs, &opts.Forecast.Horizon, "horizon", 0, "days of revenue to forecast")
+	minIntFlag(fs, &opts.Forecast.Season, "season", 1, "days in a forecasting season")
+	minIntFlag(fs, &opts.Forecast.TopContents, "forecast-contents", 0, "best contents forecast on their own")
+	fs.Func("interval", fmt.Sprintf("probability covered by the prediction intervals, between 0 and 1 (default %v)", opts.Forecast.Level), func(s string) error {
+		level, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		if !(level > 0 && level < 1) {
+			return apperr.Errorf(apperr.Config, "-interval must be strictly between 0 and 1, got %v", level)
+		}
+		opts.Forecast.Level = level
+		return nil
+	})
+	fs.IntVar(&opts.Churn.RecentDays, "churn-days", opts.Churn.RecentDays, "recent days compared with the purchase history")
+	fs.Float64Var(&opts.Churn.DropRatio, "churn-drop", opts.Churn.DropRatio, "flag customers buying less than this share of their usual rate")
+	fs.IntVar(&opts.Churn.TopDays, "churn-top-days", opts.Churn.TopDays, "flag customers leaving the top after this many consecutive days")
+	fs.Float64Var(&opts.Anomaly.Threshold, "anomaly-z", opts.Anomaly.Threshold, "robust z-score above which a purchase is flagged")
+	fs.DurationVar(&opts.Anomaly.BurstWindow, "burst-window", opts.Anomaly.BurstWindow, "time window of a purchase burst")
+	fs.IntVar(&opts.Anomaly.BurstEvents, "burst-events", opts.Anomaly.BurstEvents, "purchases of a customer within -burst-window making a burst, 0 to disable")
+	fs.BoolVar(&opts.Anomaly.Exclude, "exclude-anomalies", false, "leave the flagged purchases out of the ranking and the other results")
+	fs.BoolVar(&opts.Stream.Enabled, "stream", false, "aggregate the purchases while reading them, computing only the customer sales results")
+	fs.BoolVar(&opts.Stream.Pushdown, "pushdown", false, "with -stream, sum the quantities in MySQL with GROUP BY")
+	return func() (customeranalysis.Options, error) {
+		if opts.Stream.Enabled && opts.Anomaly.Exclude {
+			return opts, apperr.Errorf(apperr.Config, "-stream does not read the purchases, so -exclude-anomalies cannot be used with it")
+		}
+		return opts, nil
+	}
+}
+
+// minIntFlag registers an int flag that cannot be below min, defaulting to
+// the current value of p.
+func minIntFlag(fs *flag.FlagSet, p *int, name string, min int, usage string) {
+	fs.Func(name, fmt.Sprintf("%s (default %d)", usage, *p), func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		if n < min {
+			return apperr.Errorf(apperr.Config, "-%s must be at least %d, got %d", name, min, n)
+		}
+		*p = n
+		return nil
+	})
+}
+
+// analysisFlags registers the output flags shared by run and analyze. The
+// returned function builds the sinks once the flags are parsed.
+func analysisFlags(fs *flag.FlagSet) func(ctx context.Context, db *sql.DB) ([]customeranalysis.Sink, error) {
+	output := fs.String("output", "", "also export the results to this file or directory")
+	format := fs.String("format", "", "export format: csv, json, jsonl or xlsx (default from the -output extension)")
+	noDB := fs.Bool("no-db", false, "with -output, do not write the result tables to MySQL")
+	var runner customeranalysis.RunnerConfig
+	fs.IntVar(&runner.Workers, "workers", 0, "result tables written at once, 0 for one per CPU")
+	fs.BoolVar(&runner.FailFast, "fail-fast", false, "stop writing the result tables after the first failure")
+	timings := fs.Bool("timings", false, "print the duration of each result table stage")
+
+	return func(ctx context.Context, db *sql.DB) ([]customeranalysis.Sink, error) {
+		if *output != "" && database.PlanFrom(ctx) != nil {
+			return nil, apperr.Errorf(apperr.Config, "-dry-run writes nothing, -output cannot be used with it")
+		}
+		if *timings {
+			runner.OnDone = printStage
+		}
+		var sinks []customeranalysis.Sink
+		if !*noDB || *output == "" {
+			sinks = append(sinks, customeranalysis.DBSink{DB: db, Runner: runner})
+		}
+		if *output != "" {
+			sink, err := customeranalysis.NewFileSink(*output, *format)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		}
+		return sinks, nil
+	}
+}
 
-	db := database.GetDBInstance()
+// dryRunFlag registers -dry-run on the commands writing to MySQL.
+func dryRunFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("dry-run", false, "compute everything but write nothing: print the planned DDL, the rows inserted, updated and deleted per table and a sample of them")
+}
+
+// withDryRun records the writes run with ctx in a plan when enabled. report
+// prints the plan once the command succeeded.
+func withDryRun(ctx context.Context, enabled bool) (_ context.Context, report func() error) {
+	if !enabled {
+		return ctx, func() error { return nil }
+	}
+	plan := database.NewPlan()
+	return database.WithPlan(ctx, plan), func() error { return plan.Report(os.Stdout) }
+}
+
+func printStage(r customeranalysis.StageResult) {
+	status := r.Outcome()
+	if status == "failed" {
+		status += ": " + r.Err.Error()
+	}
+	fmt.Printf("%-22s %10s  %s\n", r.Name, r.Duration.Round(time.Millisecond), status)
+}
+
+func runCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	databaseFlags(fs)
+	config := generationFlags(fs)
+	options := optionsFlags(fs)
+	sinks := analysisFlags(fs)
+	dryRun := dryRunFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	opts, err := options()
+	if err != nil {
+		return err
+	}
+	cfg, err := config()
+	if err != nil {
+		return err
+	}
+	// in a dry run the analysis reads the tables without the generated rows
+	ctx, report := withDryRun(ctx, *dryRun)
+
+	db, err := database.GetDBInstance(ctx)
+	if err != nil {
+		return err
+	}
 	defer db.Close()
+	// an invalid -output fails before the data is generated
+	analysisSinks, err := sinks(ctx, db)
+	if err != nil {
+		return err
+	}
 
-	datageneration.GenerateData(db)
+	if err := datageneration.GenerateDataWithConfig(ctx, db, cfg); err != nil {
+		return err
+	}
 
-	customeranalysis.RunCustomerAnalysis(db)
+	if err := customeranalysis.RunCustomerAnalysisTo(ctx, db, opts, analysisSinks...); err != nil {
+		return err
+	}
+	return report()
+}
 
+func analyzeCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	databaseFlags(fs)
+	options := optionsFlags(fs)
+	sinks := analysisFlags(fs)
+	dryRun := dryRunFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	opts, err := options()
+	if err != nil {
+		return err
+	}
+	ctx, report := withDryRun(ctx, *dryRun)
+
+	db, err := database.GetDBInstance(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	analysisSinks, err := sinks(ctx, db)
+	if err != nil {
+		return err
+	}
+	if err := customeranalysis.RunCustomerAnalysisTo(ctx, db, opts, analysisSinks...); err != nil {
+		return err
+	}
+	return report()
+}
+
+func reportCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	databaseFlags(fs)
+	out := fs.String("out", "report.html", "HTML file to write")
+	options := optionsFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	opts, err := options()
+	if err != nil {
+		return err
+	}
+
+	db, err := database.GetDBInstance(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return customeranalysis.RunCustomerAnalysisTo(ctx, db, opts, customeranalysis.ReportSink{Path: *out})
+}
+
+func backtestCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("backtest", flag.ExitOnError)
+	databaseFlags(fs)
+	options := optionsFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	opts, err := options()
+	if err != nil {
+		return err
+	}
+	if opts.Stream.Enabled {
+		return apperr.Errorf(apperr.Config, "the backtest forecasts from every purchase, -stream cannot be used with it")
+	}
+
+	db, err := database.GetDBInstance(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	results, err := customeranalysis.BacktestForecasts(ctx, db, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-10s %-15s %5s %10s %12s\n", "series", "model", "days", "MAPE", "RMSE")
+	for _, r := range results {
+		fmt.Printf("%-10s %-15s %5d %9.1f%% %12.2f\n", r.Series, r.Model, r.Days, 100*r.MAPE, r.RMSE)
+	}
+	return nil
+}
+
+func generateCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	databaseFlags(fs)
+	config := generationFlags(fs)
+	out := fs.String("out", "", "write the tables to files in this directory instead of MySQL")
+	format := fs.String("format", "csv", "file format with -out: csv, jsonl or parquet")
+	dryRun := dryRunFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	cfg, err := config()
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		ctx, report := withDryRun(ctx, *dryRun)
+		db, err := database.GetDBInstance(ctx)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if err := datageneration.GenerateDataWithConfig(ctx, db, cfg); err != nil {
+			return err
+		}
+		return report()
+	}
+	if *dryRun {
+		return apperr.Errorf(apperr.Config, "-dry-run writes nothing, -out cannot be used with it")
+	}
+
+	fileFormat, err := datageneration.ParseFileFormat(*format)
+	if err != nil {
+		return err
+	}
+	// the database is only needed to read the existing IDs in append mode
+	var db *sql.DB
+	if cfg.Append {
+		if db, err = database.GetDBInstance(ctx); err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+	ds, err := datageneration.GenerateDataset(ctx, db, cfg)
+	if err != nil {
+		return err
+	}
+	return datageneration.WriteDataset(*out, fileFormat, ds)
+}
+
+func loadCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	databaseFlags(fs)
+	in := fs.String("in", "", "directory written by generate -out")
+	format := fs.String("format", "csv", "file format: csv, jsonl or parquet")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *in == "" {
+		return apperr.Errorf(apperr.Config, "load needs -in")
+	}
+	fileFormat, err := datageneration.ParseFileFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.GetDBInstance(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return datageneration.LoadDataset(ctx, db, *in, fileFormat)
+}
+
+// mappingFlag collects repeated -map kind.Field=column flags.
+type mappingFlag map[dataimport.Kind]map[string]string
+
+func (m mappingFlag) String() string { return "" }
+
+func (m mappingFlag) Set(spec string) error {
+	return dataimport.ParseMapping(spec, m)
+}
+
+func importCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	databaseFlags(fs)
+	files := make(map[dataimport.Kind]*string)
+	for _, kind := range dataimport.Kinds {
+		files[kind] = fs.String(string(kind), "", fmt.Sprintf("%s file (.csv or .jsonl)", kind))
+	}
+	mapping := make(mappingFlag)
+	fs.Var(mapping, "map", "column mapping kind.Field=column, can be repeated")
+	batch := fs.Int("batch", 500, "rows committed together")
+	restart := fs.Bool("restart", false, "ignore the checkpoints of a previous import")
+	errorReport := fs.String("errors", "import_errors.csv", "CSV report of the rejected rows, appended to unless -restart")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	opts := dataimport.Options{
+		Files:       make(map[dataimport.Kind]string),
+		Mapping:     mapping,
+		BatchSize:   *batch,
+		Restart:     *restart,
+		ErrorReport: *errorReport,
+	}
+	for kind, path := range files {
+		if *path != "" {
+			opts.Files[kind] = *path
+		}
+	}
+	if len(opts.Files) == 0 {
+		return apperr.Errorf(apperr.Config, "import needs at least one file")
+	}
+
+	db, err := database.GetDBInstance(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	report, err := dataimport.Import(ctx, db, opts)
+	for _, kind := range dataimport.Kinds {
+		if _, ok := opts.Files[kind]; ok {
+			fmt.Printf("%-10s inserted %d, duplicates %d, rejected %d, already loaded %d\n",
+				kind, report.Inserted[kind], report.Duplicates[kind], report.Rejected[kind], report.Skipped[kind])
+		}
+	}
+	if len(report.Errors) > 0 {
+		fmt.Printf("%d row errors written to %s\n", len(report.Errors), *errorReport)
+	}
+	return err
 }
@@ -0,0 +1,231 @@
+// Package metrics counts what a run does and writes the counts in the
+// Prometheus text format, to a file for the node_exporter textfile collector
+// or on a local /metrics endpoint.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the metrics of the tool, labelled as documented
+var (
+	// Rows counts the rows read from or written to a table, label op is
+	// read or write.
+	Rows = NewCounter("test2024_rows_total", "Rows read from or written to a table.", "table", "op")
+	// QueryDuration times the SQL statements until their rows are read,
+	// label statement is the SQL verb: select, insert, delete, create...
+	QueryDuration = NewHistogram("test2024_query_duration_seconds", "Duration of the SQL statements.", "statement")
+	// StageRuns counts the stages by outcome: ok, failed or skipped.
+	StageRuns = NewCounter("test2024_stage_runs_total", "Stages run, by outcome.", "stage", "outcome")
+	// StageDuration times the stages that were started.
+	StageDuration = NewHistogram("test2024_stage_duration_seconds", "Duration of the stages.", "stage")
+	// RunDuration is the duration of the command, set when it ends. The run
+	// ID is only logged: as a label every run would add a series.
+	RunDuration = NewGauge("test2024_run_duration_seconds", "Duration of the run.", "command", "outcome")
+)
+
+// Buckets are the upper bounds of the histograms, in seconds.
+var Buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+var (
+	mu       sync.Mutex
+	families []*family
+)
+
+type family struct {
+	name, help, typ string
+	labels          []string
+	series          map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64  // counter and gauge
+	counts []uint64 // histogram, per bucket then +Inf
+	sum    float64
+}
+
+func newFamily(name, help, typ string, labels []string) *family {
+	f := &family{name: name, help: help, typ: typ, labels: labels, series: make(map[string]*series)}
+	mu.Lock()
+	families = append(families, f)
+	mu.Unlock()
+	return f
+}
+
+// get is the series of the label values, the caller holds mu.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d labels, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...)}
+		if f.typ == "histogram" {
+			s.counts = make([]uint64, len(Buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter is a value that only goes up.
+type Counter struct{ f *family }
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newFamily(name, help, "counter", labels)}
+}
+
+// Add adds v to the series of the label values.
+func (c *Counter) Add(v float64, labels ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	c.f.get(labels).value += v
+}
+
+// Gauge is a value that is set.
+type Gauge struct{ f *family }
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{newFamily(name, help, "gauge", labels)}
+}
+
+func (g *Gauge) Set(v float64, labels ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	g.f.get(labels).value = v
+}
+
+// Histogram counts observations in Buckets.
+type Histogram struct{ f *family }
+
+func NewHistogram(name, help string, labels ...string) *Histogram {
+	return &Histogram{newFamily(name, help, "histogram", labels)}
+}
+
+func (h *Histogram) Observe(v float64, labels ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	s := h.f.get(labels)
+	i := sort.SearchFloat64s(Buckets, v) // first bound >= v
+	s.counts[i]++
+	s.sum += v
+}
+
+// WriteText writes every series in the Prometheus text format. Families
+// without series are left out.
+func WriteText(w io.Writer) error {
+	mu.Lock()
+	defer mu.Unlock()
+	var b strings.Builder
+	sorted := append([]*family(nil), families...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	for _, f := range sorted {
+		if len(f.series) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.typ)
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			f.writeSeries(&b, f.series[key])
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *family) writeSeries(b *strings.Builder, s *series) {
+	if f.typ != "histogram" {
+		fmt.Fprintf(b, "%s%s %s\n", f.name, labelText(f.labels, s.labels, "", ""), formatFloat(s.value))
+		return
+	}
+	var cumulative uint64
+	for i, count := range s.counts {
+		cumulative += count
+		bound := math.Inf(1)
+		if i < len(Buckets) {
+			bound = Buckets[i]
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, labelText(f.labels, s.labels, "le", formatFloat(bound)), cumulative)
+	}
+	fmt.Fprintf(b, "%s_sum%s %s\n", f.name, labelText(f.labels, s.labels, "", ""), formatFloat(s.sum))
+	fmt.Fprintf(b, "%s_count%s %d\n", f.name, labelText(f.labels, s.labels, "", ""), cumulative)
+}
+
+func labelText(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+// WriteFile writes the metrics to path through a temporary file, so a
+// collector never reads a partial file.
+func WriteFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error writing metrics: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := WriteText(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing metrics: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing metrics: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("error writing metrics: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing metrics: %w", err)
+	}
+	return nil
+}
+
+// Handler serves the metrics for a Prometheus scrape.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteText(w)
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"TEST2024/apperr"
+	"TEST2024/metrics"
+)
+
+// telemetry is the logging and metrics of one run, set up by parseFlags and
+// closed by main.
+type telemetry struct {
+	level       slog.Level
+	format      string
+	runID       string
+	metricsFile string
+	metricsAddr string
+	metricsWait time.Duration
+
+	command string
+	start   time.Time
+	server  *http.Server
+}
+
+var tel telemetry
+
+// parseFlags registers the logging and metrics flags of every command,
+// parses args, then starts the logger and the metrics endpoint.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.TextVar(&tel.level, "log-level", slog.LevelInfo, "lowest level logged: debug, info, warn or error")
+	fs.StringVar(&tel.format, "log-format", "text", "log format on stderr: text or json")
+	fs.StringVar(&tel.runID, "run-id", "", "ID added to every log line (default random)")
+	fs.StringVar(&tel.metricsFile, "metrics-file", "", "write the metrics in the Prometheus text format to this file when the run ends")
+	fs.StringVar(&tel.metricsAddr, "metrics-addr", "", "serve the metrics on http://ADDR/metrics while the command runs, e.g. localhost:9100")
+	fs.DurationVar(&tel.metricsWait, "metrics-wait", 0, "with -metrics-addr, keep serving this long after the run for a last scrape")
+	fs.Parse(args)
+	return tel.begin(fs.Name())
+}
+
+func (t *telemetry) begin(command string) error {
+	t.command, t.start = command, time.Now()
+	if t.runID == "" {
+		id := make([]byte, 8)
+		rand.Read(id)
+		t.runID = hex.EncodeToString(id)
+	}
+
+	options := &slog.HandlerOptions{Level: t.level}
+	var handler slog.Handler
+	switch t.format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return apperr.Errorf(apperr.Config, "unknown log format %q, want text or json", t.format)
+	}
+	slog.SetDefault(slog.New(handler).With("run_id", t.runID, "command", command))
+
+	if t.metricsAddr != "" {
+		listener, err := net.Listen("tcp", t.metricsAddr)
+		if err != nil {
+			return apperr.Wrap(apperr.Config, "serving metrics", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		t.server = &http.Server{Handler: mux}
+		go t.server.Serve(listener)
+		slog.Info("serving metrics", "url", "http://"+listener.Addr().String()+"/metrics")
+	}
+	slog.Info("run started")
+	return nil
+}
+
+// end logs the outcome of the run and publishes its metrics. The error is
+// the one of writing the metrics file.
+func (t *telemetry) end(ctx context.Context, err error) error {
+	if t.command == "" {
+		return nil // the flags were not parsed
+	}
+	elapsed := time.Since(t.start)
+	outcome := "ok"
+	switch {
+	case errors.Is(err, context.Canceled):
+		outcome = "interrupted"
+	case err != nil:
+		outcome = "failed"
+	}
+	metrics.RunDuration.Set(elapsed.Seconds(), t.command, outcome)
+	if err != nil {
+		slog.Error("run failed", "duration", elapsed, "kind", apperr.KindOf(err).String(), "error", err)
+	} else {
+		slog.Info("run done", "duration", elapsed)
+	}
+
+	var writeErr error
+	if t.metricsFile != "" {
+		if writeErr = metrics.WriteFile(t.metricsFile); writeErr != nil {
+			slog.Error("metrics not written", "error", writeErr)
+		}
+	}
+	if t.server != nil {
+		select {
+		case <-time.After(t.metricsWait):
+		case <-ctx.Done():
+		}
+		t.server.Close()
+	}
+	return writeErr
+}